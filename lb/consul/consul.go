@@ -5,157 +5,622 @@
 package consul
 
 import (
+	"errors"
 	"log"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/consul/api"
-	"google.golang.org/grpc/naming"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/olivere/grpc/lb/internal/resolverutil"
+	"github.com/olivere/grpc/lb/locality"
+	"github.com/olivere/grpc/lb/weighted"
+)
+
+// Scheme is the scheme the Builder is registered with in gRPC.
+// Use e.g. "consul:///echo?tag=prod" as a target to resolve the
+// "echo" service with the "prod" tag via the local Consul agent.
+const Scheme = "consul"
+
+var (
+	defaultFailoverWaitTime = 30 * time.Second
+	defaultMinQueryInterval = 1 * time.Second
+	defaultBackoffBase      = 1 * time.Second
+	defaultBackoffMax       = 2 * time.Minute
+	defaultZoneKey          = "zone"
+
+	// ErrNoService is returned when the target does not specify a service.
+	ErrNoService = errors.New("no service specified")
+
+	// ErrInvalidHealthFilter is returned for an unknown health filter.
+	ErrInvalidHealthFilter = errors.New("invalid health filter")
+)
+
+// HealthFilter specifies which instances the Resolver returns,
+// depending on the aggregated status of their health checks.
+type HealthFilter int
+
+const (
+	// PassingOnly returns instances whose checks are all passing.
+	// This is the default.
+	PassingOnly HealthFilter = iota
+	// PassingOrWarning returns instances whose checks are passing
+	// or in warning state.
+	PassingOrWarning
+	// AnyHealth returns all instances, even if a check is critical.
+	// Instances in maintenance mode are never returned.
+	AnyHealth
 )
 
+// ParseHealthFilter parses a health filter from a string as used
+// in the "health" query parameter of a target, i.e. one of "passing",
+// "warning", or "any".
+func ParseHealthFilter(s string) (HealthFilter, error) {
+	switch s {
+	case "", api.HealthPassing:
+		return PassingOnly, nil
+	case api.HealthWarning:
+		return PassingOrWarning, nil
+	case api.HealthAny:
+		return AnyHealth, nil
+	}
+	return PassingOnly, ErrInvalidHealthFilter
+}
+
+func init() {
+	resolver.Register(NewBuilder(nil))
+}
+
+// Builder implements the gRPC resolver.Builder interface. It creates
+// a Resolver for targets of the form consul://[agent]/service[?tag=tag].
+// Use the "health" query parameter to change the health filter, e.g.
+// consul:///echo?health=warning (see ParseHealthFilter). Use the "query"
+// parameter to execute a prepared query instead of looking up a service,
+// e.g. consul:///?query=echo-failover (see SetPreparedQuery).
+//
+// The Builder for the default Consul client is registered with gRPC
+// automatically. Use NewBuilder together with grpc.WithResolvers if you
+// need to pass a custom Consul client.
+type Builder struct {
+	client  *api.Client
+	options []ResolverOption
+}
+
+// NewBuilder initializes and returns a new Builder. If client is nil,
+// a Consul client with the default configuration is created for every
+// Resolver. The authority of the target, if specified, overrides the
+// address of the Consul agent in that case.
+//
+// The options are applied to every Resolver created by the Builder.
+func NewBuilder(client *api.Client, options ...ResolverOption) *Builder {
+	return &Builder{client: client, options: options}
+}
+
+// Scheme returns the scheme supported by the Builder.
+func (b *Builder) Scheme() string {
+	return Scheme
+}
+
+// Build creates a new Resolver for the given target.
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	client := b.client
+	if client == nil {
+		cfg := api.DefaultConfig()
+		if target.URL.Host != "" {
+			cfg.Address = target.URL.Host
+		}
+		var err error
+		client, err = api.NewClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	query := target.URL.Query()
+	options := append([]ResolverOption{}, b.options...)
+	if s := query.Get("health"); s != "" {
+		filter, err := ParseHealthFilter(s)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, SetHealthFilter(filter))
+	}
+	if s := query.Get("query"); s != "" {
+		options = append(options, SetPreparedQuery(s))
+	}
+	return newResolver(cc, client, target.Endpoint(), query.Get("tag"), options...)
+}
+
 // Resolver implements the gRPC Resolver interface using a Consul backend.
+// It watches Consul for changes of the service with blocking queries and
+// pushes the current list of addresses to the gRPC ClientConn.
 //
 // See the gRPC load balancing documentation for details about Balancer and
 // Resolver: https://github.com/grpc/grpc/blob/master/doc/load-balancing.md.
 type Resolver struct {
-	c           *api.Client
-	service     string
-	tag         string
-	passingOnly bool
+	cc      resolver.ClientConn
+	c       *api.Client
+	service string
+	tag     string
+
+	healthFilter   HealthFilter
+	requiredChecks []string
+	ignoredChecks  []string
+
+	datacenter          string
+	failoverDatacenters []string
+	failoverWaitTime    time.Duration
+	namespace           string
+	partition           string
+	token               string
+	filter              string
+	near                string
+	zoneKey             string
+	inFailover          bool // true if the last instances came from a failover datacenter
+
+	preparedQuery string
+	queryInterval time.Duration
 
-	quitc    chan struct{}
-	updatesc chan []*naming.Update
+	waitTime         time.Duration
+	minQueryInterval time.Duration
+	backoffBase      time.Duration
+	backoffMax       time.Duration
+
+	panicThreshold float64
+	panicking      int32 // 1 while in panic mode, see SetPanicThreshold
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
-// NewResolver initializes and returns a new Resolver.
+// ResolverOption is a callback for setting the options of the Resolver.
+type ResolverOption func(*Resolver) error
+
+// newResolver initializes and returns a new Resolver.
 //
 // It resolves addresses for gRPC connections to the given service and tag.
 // If the tag is irrelevant, use an empty string.
-func NewResolver(client *api.Client, service, tag string) (*Resolver, error) {
+func newResolver(cc resolver.ClientConn, client *api.Client, service, tag string, options ...ResolverOption) (*Resolver, error) {
 	r := &Resolver{
-		c:           client,
-		service:     service,
-		tag:         tag,
-		passingOnly: true,
-		quitc:       make(chan struct{}),
-		updatesc:    make(chan []*naming.Update, 1),
+		cc:               cc,
+		c:                client,
+		service:          service,
+		tag:              tag,
+		healthFilter:     PassingOnly,
+		failoverWaitTime: defaultFailoverWaitTime,
+		queryInterval:    defaultQueryInterval,
+		minQueryInterval: defaultMinQueryInterval,
+		backoffBase:      defaultBackoffBase,
+		backoffMax:       defaultBackoffMax,
+		zoneKey:          defaultZoneKey,
+	}
+	for _, option := range options {
+		if err := option(r); err != nil {
+			return nil, err
+		}
 	}
+	if r.service == "" && r.preparedQuery == "" {
+		return nil, ErrNoService
+	}
+	if r.preparedQuery != "" && (r.service != "" || r.tag != "" || r.filter != "" || len(r.failoverDatacenters) > 0) {
+		return nil, ErrPreparedQueryOption
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
 
-	// Retrieve instances immediately
+	// Prepared queries don't support blocking queries, so we execute
+	// them periodically
+	if r.preparedQuery != "" {
+		instances, err := r.executeQuery()
+		if err != nil {
+			resolverutil.ReportError(r.cc, "grpc/lb/consul: error executing prepared query", err)
+		} else {
+			r.updateState(instances)
+		}
+		r.wg.Add(1)
+		go r.queryUpdater(instances, err == nil)
+		return r, nil
+	}
+
+	// Retrieve instances immediately. Push the state even if there are
+	// no instances, so RPCs fail instead of waiting for the resolver.
 	instances, index, err := r.getInstances(0)
-	if err != nil {
-		log.Printf("grpc/lb/consul: error retrieving instances from Consul: %v", err)
+	updated := err == nil || r.inFailover
+	if updated {
+		r.updateState(instances)
 	}
-	updates := r.makeUpdates(nil, instances)
-	if len(updates) > 0 {
-		r.updatesc <- updates
+	if err != nil {
+		r.handleError(err)
 	}
 
 	// Start updater
-	go r.updater(instances, index)
+	r.wg.Add(1)
+	go r.updater(instances, index, updated)
 
 	return r, nil
 }
 
-// Resolve creates a watcher for target. The watcher interface is implemented
-// by Resolver as well, see Next and Close.
-func (r *Resolver) Resolve(target string) (naming.Watcher, error) {
-	return r, nil
+// SetHealthFilter specifies which instances to return, depending on
+// the status of their health checks. The default is PassingOnly.
+func SetHealthFilter(filter HealthFilter) ResolverOption {
+	return func(r *Resolver) error {
+		switch filter {
+		case PassingOnly, PassingOrWarning, AnyHealth:
+			r.healthFilter = filter
+			return nil
+		}
+		return ErrInvalidHealthFilter
+	}
 }
 
-// Next blocks until an update or error happens. It may return one or more
-// updates. The first call will return the full set of instances available
-// as NewResolver will look those up. Subsequent calls to Next() will
-// block until the resolver finds any new or removed instance.
+// SetRequiredChecks specifies checks, by ID or name, that must be passing
+// for an instance to be returned, regardless of the health filter.
+func SetRequiredChecks(checks ...string) ResolverOption {
+	return func(r *Resolver) error {
+		r.requiredChecks = checks
+		return nil
+	}
+}
+
+// SetIgnoredChecks specifies checks, by ID or name, that are disregarded
+// when determining the health status of an instance. Use this e.g. for
+// non-critical checks that should not drain the whole fleet when flapping.
+func SetIgnoredChecks(checks ...string) ResolverOption {
+	return func(r *Resolver) error {
+		r.ignoredChecks = checks
+		return nil
+	}
+}
+
+// SetDatacenter specifies the datacenter to query. It defaults to the
+// datacenter of the Consul agent.
+func SetDatacenter(dc string) ResolverOption {
+	return func(r *Resolver) error {
+		r.datacenter = dc
+		return nil
+	}
+}
+
+// SetFailoverDatacenters specifies an ordered list of datacenters to query
+// when there are no healthy instances in the datacenter. The instances of
+// the first datacenter in the list that has healthy instances are returned.
+//
+// The failover datacenters are also queried when the query against the
+// datacenter fails, e.g. because it is unreachable. The Resolver keeps
+// retrying the datacenter with exponential backoff (see SetBackoff), and
+// fails back as soon as it has healthy instances again.
 //
-// An error is returned if and only if the watcher cannot recover.
-func (r *Resolver) Next() ([]*naming.Update, error) {
-	return <-r.updatesc, nil
+// While resolving to a failover datacenter, the Resolver checks for
+// changes at least every 30 seconds, see SetFailoverWaitTime.
+func SetFailoverDatacenters(dcs ...string) ResolverOption {
+	return func(r *Resolver) error {
+		r.failoverDatacenters = dcs
+		return nil
+	}
 }
 
-// Close closes the watcher.
-func (r *Resolver) Close() {
-	select {
-	case <-r.quitc:
-	default:
-		close(r.quitc)
-		close(r.updatesc)
+// SetFailoverWaitTime specifies the maximum duration of a blocking query
+// while resolving to a failover datacenter. Changes in the failover
+// datacenter are picked up after this duration at the latest.
+func SetFailoverWaitTime(waitTime time.Duration) ResolverOption {
+	return func(r *Resolver) error {
+		r.failoverWaitTime = waitTime
+		return nil
+	}
+}
+
+// SetNamespace specifies the namespace of the service (Consul Enterprise).
+func SetNamespace(namespace string) ResolverOption {
+	return func(r *Resolver) error {
+		r.namespace = namespace
+		return nil
+	}
+}
+
+// SetPartition specifies the admin partition of the service
+// (Consul Enterprise).
+func SetPartition(partition string) ResolverOption {
+	return func(r *Resolver) error {
+		r.partition = partition
+		return nil
 	}
 }
 
-// updater is a background process started in NewResolver. It takes
-// a list of previously resolved instances (in the format of host:port, e.g.
-// 192.168.0.1:1234) and the last index returned from Consul.
-func (r *Resolver) updater(instances []string, lastIndex uint64) {
+// SetToken specifies the ACL token to use for queries. It overrides
+// the token of the Consul client.
+func SetToken(token string) ResolverOption {
+	return func(r *Resolver) error {
+		r.token = token
+		return nil
+	}
+}
+
+// SetFilter specifies a filter expression that Consul applies to the
+// service instances, e.g. `Service.Meta.version == "2"`.
+// See https://developer.hashicorp.com/consul/api-docs/features/filtering.
+func SetFilter(filter string) ResolverOption {
+	return func(r *Resolver) error {
+		r.filter = filter
+		return nil
+	}
+}
+
+// SetWaitTime specifies the maximum duration of a blocking query.
+// It defaults to the wait time of Consul, i.e. 5 minutes.
+func SetWaitTime(waitTime time.Duration) ResolverOption {
+	return func(r *Resolver) error {
+		r.waitTime = waitTime
+		return nil
+	}
+}
+
+// SetMinQueryInterval specifies the minimum duration between two
+// blocking queries, so that frequent changes don't overwhelm Consul.
+// It defaults to 1 second.
+func SetMinQueryInterval(interval time.Duration) ResolverOption {
+	return func(r *Resolver) error {
+		r.minQueryInterval = interval
+		return nil
+	}
+}
+
+// SetBackoff specifies the exponential backoff after errors retrieving
+// instances from Consul. The first retry happens after base, then the
+// duration doubles with every failure up to max. A random jitter of up to
+// 50% is subtracted from every duration. It defaults to 1 second and
+// 2 minutes respectively.
+func SetBackoff(base, max time.Duration) ResolverOption {
+	return func(r *Resolver) error {
+		r.backoffBase = base
+		r.backoffMax = max
+		return nil
+	}
+}
+
+// SetNear specifies a node name to sort the instances by estimated
+// round trip time from that node. Use "_agent" for the Consul agent.
+func SetNear(node string) ResolverOption {
+	return func(r *Resolver) error {
+		r.near = node
+		return nil
+	}
+}
+
+// SetZoneKey specifies the key of the node metadata that contains the
+// zone of an instance, e.g. its availability zone. The Resolver attaches
+// the zone to the address of the instance for the locality balancer
+// (see package locality). It defaults to "zone".
+func SetZoneKey(key string) ResolverOption {
+	return func(r *Resolver) error {
+		r.zoneKey = key
+		return nil
+	}
+}
+
+// ResolveNow is a no-op for a Resolver. It watches Consul with blocking
+// queries and picks up changes as soon as they happen.
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+// Close closes the resolver. It cancels all outstanding queries and
+// waits for the background process to finish, so the ClientConn receives
+// no more updates after Close returns. It is safe to call Close more
+// than once.
+func (r *Resolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// updater is a background process started in newResolver. It takes
+// a list of previously resolved instances (with an address in the format
+// of host:port, e.g. 192.168.0.1:1234), the last index returned from Consul,
+// and whether the instances have been pushed to the ClientConn already.
+func (r *Resolver) updater(instances []resolver.Address, lastIndex uint64, updated bool) {
+	defer r.wg.Done()
+
 	var err error
 	var oldInstances = instances
-	var newInstances []string
+	var newInstances []resolver.Address
+	var lastQuery time.Time
+	var retries int
 
-	// TODO Cache the updates for a while, so that we don't overwhelm Consul.
 	for {
-		select {
-		case <-r.quitc:
-			break
-		default:
-			newInstances, lastIndex, err = r.getInstances(lastIndex)
-			if err != nil {
-				log.Printf("grpc/lb/consul: error retrieving instances from Consul: %v", err)
-				continue
-			}
-			updates := r.makeUpdates(oldInstances, newInstances)
-			if len(updates) > 0 {
-				r.updatesc <- updates
+		// Don't overwhelm Consul when changes happen frequently
+		if !resolverutil.Wait(r.ctx, r.minQueryInterval-time.Since(lastQuery)) {
+			return
+		}
+		lastQuery = time.Now()
+
+		newInstances, lastIndex, err = r.getInstances(lastIndex)
+		if r.ctx.Err() != nil {
+			// Resolver has been closed
+			return
+		}
+		if err == nil || r.inFailover {
+			added, deleted := resolverutil.MakeUpdates(oldInstances, newInstances)
+			if !updated || len(added) > 0 || len(deleted) > 0 {
+				r.updateState(newInstances)
+				updated = true
 			}
 			oldInstances = newInstances
 		}
+		if err == nil {
+			retries = 0
+			continue
+		}
+		r.handleError(err)
+		retries++
+		if !resolverutil.Wait(r.ctx, resolverutil.Backoff(r.backoffBase, r.backoffMax, retries)) {
+			return
+		}
 	}
 }
 
+// handleError reports an error retrieving instances from the datacenter.
+// While resolving to a failover datacenter, the error is only logged, as
+// the ClientConn has instances to connect to.
+func (r *Resolver) handleError(err error) {
+	if r.inFailover {
+		log.Printf("grpc/lb/consul: error retrieving instances from Consul, using failover datacenter: %v", err)
+		return
+	}
+	resolverutil.ReportError(r.cc, "grpc/lb/consul: error retrieving instances from Consul", err)
+}
+
+// updateState pushes the given list of instances to the ClientConn.
+func (r *Resolver) updateState(instances []resolver.Address) {
+	r.cc.UpdateState(resolver.State{Addresses: instances})
+}
+
 // getInstances retrieves the new set of instances registered for the
-// service from Consul.
-func (r *Resolver) getInstances(lastIndex uint64) ([]string, uint64, error) {
-	services, meta, err := r.c.Health().Service(r.service, r.tag, r.passingOnly, &api.QueryOptions{
-		WaitIndex: lastIndex,
-	})
+// service from Consul. If there are no healthy instances, or the query
+// fails, it returns the instances of the first failover datacenter that
+// has healthy instances, together with the error of the query if any.
+// The returned index is always the one of the blocking query against the
+// primary datacenter.
+func (r *Resolver) getInstances(lastIndex uint64) ([]resolver.Address, uint64, error) {
+	waitTime := r.waitTime
+	if r.inFailover {
+		waitTime = r.failoverWaitTime
+	}
+	instances, all, index, err := r.queryInstances(r.datacenter, lastIndex, waitTime)
+	if err == nil && len(instances) > 0 {
+		r.inFailover = false
+		return r.applyPanicThreshold(instances, all), index, nil
+	}
+	if r.ctx.Err() != nil {
+		return nil, lastIndex, r.ctx.Err()
+	}
+
+	for _, dc := range r.failoverDatacenters {
+		failover, failoverAll, _, ferr := r.queryInstances(dc, 0, 0)
+		if ferr != nil {
+			if r.ctx.Err() != nil {
+				return nil, lastIndex, r.ctx.Err()
+			}
+			log.Printf("grpc/lb/consul: error retrieving instances from datacenter %s: %v", dc, ferr)
+			continue
+		}
+		if len(failover) > 0 {
+			r.inFailover = true
+			return r.applyPanicThreshold(failover, failoverAll), index, err
+		}
+	}
+	r.inFailover = false
 	if err != nil {
 		return nil, lastIndex, err
 	}
+	return r.applyPanicThreshold(instances, all), index, nil
+}
 
-	var instances []string
+// queryInstances retrieves the instances of the service in the given
+// datacenter. Every instance has its Metadata attached, as well as its
+// weight for the current health status (see package weighted).
+// It returns the instances that pass the health filter, and all instances
+// that are not in maintenance if the panic mode is enabled.
+func (r *Resolver) queryInstances(dc string, lastIndex uint64, waitTime time.Duration) ([]resolver.Address, []resolver.Address, uint64, error) {
+	// Let Consul filter by health if we can
+	passingOnly := r.healthFilter == PassingOnly && len(r.ignoredChecks) == 0 && r.panicThreshold <= 0
+	services, meta, err := r.c.Health().Service(r.service, r.tag, passingOnly, (&api.QueryOptions{
+		Datacenter: dc,
+		Namespace:  r.namespace,
+		Partition:  r.partition,
+		Token:      r.token,
+		Filter:     r.filter,
+		Near:       r.near,
+		WaitIndex:  lastIndex,
+		WaitTime:   waitTime,
+	}).WithContext(r.ctx))
+	if err != nil {
+		return nil, nil, lastIndex, err
+	}
+	instances, all := r.makeInstances(services)
+	return instances, all, meta.LastIndex, nil
+}
+
+// makeInstances converts the service entries returned from Consul into
+// addresses. It returns the instances that pass the health filter, and
+// all instances that are not in maintenance.
+func (r *Resolver) makeInstances(services []*api.ServiceEntry) (instances, all []resolver.Address) {
 	for _, service := range services {
+		status, ok := r.healthStatus(service.Checks)
+		if !ok && service.Checks.AggregatedStatus() == api.HealthMaint {
+			continue
+		}
 		s := service.Service.Address
 		if len(s) == 0 {
 			s = service.Node.Address
 		}
-		addr := net.JoinHostPort(s, strconv.Itoa(service.Service.Port))
-		instances = append(instances, addr)
+		addr := resolver.Address{
+			Addr: net.JoinHostPort(s, strconv.Itoa(service.Service.Port)),
+		}
+		addr = setMetadata(addr, Metadata{
+			ServiceID:  service.Service.ID,
+			Tags:       service.Service.Tags,
+			Meta:       service.Service.Meta,
+			Datacenter: service.Node.Datacenter,
+			NodeMeta:   service.Node.Meta,
+		})
+		weight := service.Service.Weights.Passing
+		if status == api.HealthWarning {
+			weight = service.Service.Weights.Warning
+		}
+		if weight > 0 {
+			addr = weighted.SetWeight(addr, uint32(weight))
+		}
+		if zone := service.Node.Meta[r.zoneKey]; zone != "" {
+			addr = locality.SetZone(addr, zone)
+		}
+		if ok {
+			instances = append(instances, addr)
+		}
+		all = append(all, addr)
 	}
-	return instances, meta.LastIndex, nil
+	return instances, all
 }
 
-// makeUpdates calculates the difference between and old and a new set of
-// instances and turns it into an array of naming.Updates.
-func (r *Resolver) makeUpdates(oldInstances, newInstances []string) []*naming.Update {
-	oldAddr := make(map[string]struct{}, len(oldInstances))
-	for _, instance := range oldInstances {
-		oldAddr[instance] = struct{}{}
+// healthStatus returns the aggregated status of the given checks, without
+// the ignored checks. It returns false if the instance with these checks
+// must be skipped, according to the health filter and required checks.
+func (r *Resolver) healthStatus(checks api.HealthChecks) (string, bool) {
+	var relevant api.HealthChecks
+	for _, check := range checks {
+		if !containsCheck(r.ignoredChecks, check) {
+			relevant = append(relevant, check)
+		}
 	}
-	newAddr := make(map[string]struct{}, len(newInstances))
-	for _, instance := range newInstances {
-		newAddr[instance] = struct{}{}
+	for _, id := range r.requiredChecks {
+		var passing bool
+		for _, check := range relevant {
+			if (check.CheckID == id || check.Name == id) && check.Status == api.HealthPassing {
+				passing = true
+				break
+			}
+		}
+		if !passing {
+			return "", false
+		}
 	}
 
-	var updates []*naming.Update
-	for addr := range newAddr {
-		if _, ok := oldAddr[addr]; !ok {
-			updates = append(updates, &naming.Update{Op: naming.Add, Addr: addr})
-		}
+	status := relevant.AggregatedStatus()
+	switch r.healthFilter {
+	case PassingOrWarning:
+		return status, status == api.HealthPassing || status == api.HealthWarning
+	case AnyHealth:
+		return status, status != api.HealthMaint
+	default:
+		return status, status == api.HealthPassing
 	}
-	for addr := range oldAddr {
-		if _, ok := newAddr[addr]; !ok {
-			updates = append(updates, &naming.Update{Op: naming.Delete, Addr: addr})
+}
+
+// containsCheck returns true if the ID or name of check is in list.
+func containsCheck(list []string, check *api.HealthCheck) bool {
+	for _, id := range list {
+		if check.CheckID == id || check.Name == id {
+			return true
 		}
 	}
-
-	return updates
+	return false
 }
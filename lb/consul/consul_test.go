@@ -5,15 +5,66 @@
 package consul
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/testutil"
 
-	"google.golang.org/grpc/naming"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/olivere/grpc/lb/locality"
 )
 
+// testClientConn implements resolver.ClientConn and records the
+// states pushed by the Resolver.
+type testClientConn struct {
+	resolver.ClientConn // unimplemented methods panic
+
+	statec chan resolver.State
+	errc   chan error
+}
+
+func newTestClientConn() *testClientConn {
+	return &testClientConn{
+		statec: make(chan resolver.State, 10),
+		errc:   make(chan error, 10),
+	}
+}
+
+func (cc *testClientConn) UpdateState(state resolver.State) error {
+	cc.statec <- state
+	return nil
+}
+
+func (cc *testClientConn) ReportError(err error) {
+	select {
+	case cc.errc <- err:
+	default:
+	}
+}
+
+// waitForState waits for the next state pushed to cc.
+func (cc *testClientConn) waitForState(t *testing.T) resolver.State {
+	t.Helper()
+	select {
+	case state := <-cc.statec:
+		return state
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for resolver state")
+	}
+	return resolver.State{}
+}
+
 func TestResolver(t *testing.T) {
 	srv, err := testutil.NewTestServerConfigT(t, func(c *testutil.TestServerConfig) {
 		c.Stdout = ioutil.Discard
@@ -53,33 +104,542 @@ func TestResolver(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	r, err := NewResolver(client, "service", "")
+	cc := newTestClientConn()
+	r, err := NewBuilder(client).Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/service"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	state := cc.waitForState(t)
+	if want, have := 2, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+	if state.Addresses[0].Addr != "192.168.1.100:16384" && state.Addresses[0].Addr != "192.168.1.101:16385" {
+		t.Fatalf("1st Addr: have %q", state.Addresses[0].Addr)
+	}
+	if state.Addresses[1].Addr != "192.168.1.100:16384" && state.Addresses[1].Addr != "192.168.1.101:16385" {
+		t.Fatalf("2nd Addr: have %q", state.Addresses[1].Addr)
+	}
+	for _, addr := range state.Addresses {
+		md, ok := MetadataFromAddress(addr)
+		if !ok {
+			t.Fatalf("%s: expected Metadata", addr.Addr)
+		}
+		if addr.Addr == "192.168.1.100:16384" && !md.HasTag("production") {
+			t.Fatalf("%s: want tag %q, have %v", addr.Addr, "production", md.Tags)
+		}
+		if addr.Addr == "192.168.1.101:16385" && !md.HasTag("canary") {
+			t.Fatalf("%s: want tag %q, have %v", addr.Addr, "canary", md.Tags)
+		}
+	}
+
+	// Deregister service-2, and we should receive the remaining address
+	if err := client.Agent().ServiceDeregister("service-2"); err != nil {
+		t.Fatal(err)
+	}
+	state = cc.waitForState(t)
+	if want, have := 1, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+	if want, have := "192.168.1.100:16384", state.Addresses[0].Addr; want != have {
+		t.Fatalf("1st Addr: want %q, have %q", want, have)
+	}
+}
+
+func TestBuilderWithoutService(t *testing.T) {
+	_, err := NewBuilder(nil).Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, newTestClientConn(), resolver.BuildOptions{})
+	if want, have := ErrNoService, err; want != have {
+		t.Fatalf("Build: want %v, have %v", want, have)
+	}
+}
+
+func TestBuilderWithInvalidHealthFilter(t *testing.T) {
+	u, err := url.Parse("consul:///service?health=unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewBuilder(nil).Build(resolver.Target{URL: *u}, newTestClientConn(), resolver.BuildOptions{})
+	if want, have := ErrInvalidHealthFilter, err; want != have {
+		t.Fatalf("Build: want %v, have %v", want, have)
+	}
+}
+
+func TestHealthStatus(t *testing.T) {
+	checks := api.HealthChecks{
+		{CheckID: "serfHealth", Name: "Serf Health Status", Status: api.HealthPassing},
+		{CheckID: "service:service-1", Name: "grpc", Status: api.HealthPassing},
+		{CheckID: "service:service-1:disk", Name: "disk", Status: api.HealthWarning},
+		{CheckID: "service:service-1:cache", Name: "cache", Status: api.HealthCritical},
+	}
+
+	tests := []struct {
+		Options []ResolverOption
+		Status  string
+		OK      bool
+	}{
+		{
+			Options: nil,
+			Status:  api.HealthCritical,
+			OK:      false,
+		},
+		{
+			Options: []ResolverOption{SetHealthFilter(AnyHealth)},
+			Status:  api.HealthCritical,
+			OK:      true,
+		},
+		{
+			Options: []ResolverOption{SetIgnoredChecks("cache")},
+			Status:  api.HealthWarning,
+			OK:      false,
+		},
+		{
+			Options: []ResolverOption{SetIgnoredChecks("cache"), SetHealthFilter(PassingOrWarning)},
+			Status:  api.HealthWarning,
+			OK:      true,
+		},
+		{
+			Options: []ResolverOption{SetIgnoredChecks("cache", "service:service-1:disk")},
+			Status:  api.HealthPassing,
+			OK:      true,
+		},
+		{
+			Options: []ResolverOption{SetHealthFilter(AnyHealth), SetRequiredChecks("grpc")},
+			Status:  api.HealthCritical,
+			OK:      true,
+		},
+		{
+			Options: []ResolverOption{SetHealthFilter(AnyHealth), SetRequiredChecks("grpc", "disk")},
+			Status:  "",
+			OK:      false,
+		},
+		{
+			Options: []ResolverOption{SetHealthFilter(AnyHealth), SetRequiredChecks("grpc"), SetIgnoredChecks("grpc")},
+			Status:  "",
+			OK:      false,
+		},
+	}
+	for i, tt := range tests {
+		r := &Resolver{}
+		for _, option := range tt.Options {
+			if err := option(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		status, ok := r.healthStatus(checks)
+		if want, have := tt.Status, status; want != have {
+			t.Errorf("#%d: status: want %q, have %q", i, want, have)
+		}
+		if want, have := tt.OK, ok; want != have {
+			t.Errorf("#%d: ok: want %v, have %v", i, want, have)
+		}
+	}
+
+	// Instances in maintenance mode are never returned
+	r := &Resolver{healthFilter: AnyHealth}
+	maint := append(checks, &api.HealthCheck{CheckID: api.NodeMaint, Status: api.HealthCritical})
+	if _, ok := r.healthStatus(maint); ok {
+		t.Errorf("maintenance: ok: want %v, have %v", false, ok)
+	}
+}
+
+func TestResolverReportsErrors(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// There's no Consul agent listening on this address
+	client, err := api.NewClient(&api.Config{Address: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := newTestClientConn()
+	b := NewBuilder(client, SetBackoff(10*time.Millisecond, 20*time.Millisecond), SetMinQueryInterval(0))
+	r, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/service"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Initial lookup and at least one retry must report errors
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-cc.errc:
+			if err == nil {
+				t.Fatal("expected error")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for ReportError")
+		}
+	}
+}
+
+func TestResolverClose(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// srv answers the initial query and then blocks, like a blocking
+	// query without any changes
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") == "" {
+			w.Header().Set("X-Consul-Index", "1")
+			w.Write([]byte("[]"))
+			return
+		}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	client, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := newTestClientConn()
+	r, err := NewBuilder(client, SetMinQueryInterval(0)).Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/service"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The ClientConn must learn that there are no instances
+	if state := cc.waitForState(t); len(state.Addresses) != 0 {
+		t.Fatalf("want no addresses, have %v", state.Addresses)
+	}
+
+	// Give the updater a chance to run into the blocking query
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		r.Close() // must be safe to call twice
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not cancel the blocking query")
+	}
+
+	// No more updates or errors after Close
+	select {
+	case state := <-cc.statec:
+		t.Fatalf("unexpected state after Close: %+v", state)
+	case err := <-cc.errc:
+		t.Fatalf("unexpected error after Close: %v", err)
+	default:
+	}
+}
+
+func TestResolverWithoutInstances(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// srv fails at first, then has no instances, and then has one instance
+	var queries int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&queries, 1)
+		w.Header().Set("X-Consul-Index", strconv.Itoa(int(n)))
+		switch n {
+		case 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		case 2:
+			w.Write([]byte("[]"))
+		case 3:
+			w.Write([]byte(`[{"Node":{"Address":"10.0.0.1"},"Service":{"ID":"service-1","Port":9000},"Checks":[]}]`))
+		default:
+			<-r.Context().Done()
+		}
+	}))
+	defer srv.Close()
+
+	client, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
 	if err != nil {
 		t.Fatal(err)
 	}
-	w, err := r.Resolve("")
+	cc := newTestClientConn()
+	b := NewBuilder(client, SetMinQueryInterval(0), SetBackoff(10*time.Millisecond, 10*time.Millisecond))
+	r, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/service"}}, cc, resolver.BuildOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer w.Close()
+	defer r.Close()
+
+	// The ClientConn must learn that there are no instances after the error
+	state := cc.waitForState(t)
+	if want, have := 0, len(state.Addresses); want != have {
+		t.Fatalf("want %d addresses, have %d", want, have)
+	}
+	state = cc.waitForState(t)
+	if want, have := 1, len(state.Addresses); want != have {
+		t.Fatalf("want %d addresses, have %d", want, have)
+	}
+}
+
+func TestMakeInstancesWithZone(t *testing.T) {
+	services := []*api.ServiceEntry{
+		{
+			Node:    &api.Node{Node: "node-1", Address: "10.0.0.1", Meta: map[string]string{"zone": "eu-west-1a", "az": "1a"}},
+			Service: &api.AgentService{ID: "service-1", Service: "service", Port: 9000},
+		},
+		{
+			Node:    &api.Node{Node: "node-2", Address: "10.0.0.2"},
+			Service: &api.AgentService{ID: "service-2", Service: "service", Port: 9000},
+		},
+	}
+	tests := []struct {
+		Options []ResolverOption
+		Zones   []string
+	}{
+		{nil, []string{"eu-west-1a", ""}},
+		{[]ResolverOption{SetZoneKey("az")}, []string{"1a", ""}},
+		{[]ResolverOption{SetZoneKey("rack")}, []string{"", ""}},
+	}
+	for i, tt := range tests {
+		r := &Resolver{zoneKey: defaultZoneKey}
+		for _, option := range tt.Options {
+			if err := option(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		instances, _ := r.makeInstances(services)
+		if want, have := len(tt.Zones), len(instances); want != have {
+			t.Fatalf("#%d: want %d instances, have %d", i, want, have)
+		}
+		for j, addr := range instances {
+			if want, have := tt.Zones[j], locality.Zone(addr); want != have {
+				t.Errorf("#%d: %s: want zone %q, have %q", i, addr.Addr, want, have)
+			}
+		}
+	}
+}
+
+// testConsul is a fake Consul agent for the health endpoint. It serves
+// the instances of every datacenter, and supports blocking queries.
+type testConsul struct {
+	mu        sync.Mutex
+	instances map[string]string // JSON of the service entries by datacenter
+	failing   map[string]bool
+	index     map[string]uint64
+	changed   chan struct{} // closed on every change
+	requests  []*http.Request
+}
+
+func newTestConsul() *testConsul {
+	return &testConsul{
+		instances: make(map[string]string),
+		failing:   make(map[string]bool),
+		index:     make(map[string]uint64),
+		changed:   make(chan struct{}),
+	}
+}
+
+// set changes the instances of datacenter dc to a single passing
+// instance with the given address, or to none if addr is empty.
+func (c *testConsul) set(dc, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.instances[dc] = "[]"
+	if addr != "" {
+		c.instances[dc] = fmt.Sprintf(`[{"Node":{"Address":%q,"Datacenter":%q},"Service":{"ID":"service-1","Port":9000},"Checks":[]}]`, addr, dc)
+	}
+	c.failing[dc] = false
+	c.index[dc]++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// fail lets all queries against datacenter dc fail until the next set.
+func (c *testConsul) fail(dc string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failing[dc] = true
+	c.index[dc]++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// lastRequest returns the last query against datacenter dc.
+func (c *testConsul) lastRequest(dc string) *http.Request {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(c.requests) - 1; i >= 0; i-- {
+		if c.requests[i].URL.Query().Get("dc") == dc {
+			return c.requests[i]
+		}
+	}
+	return nil
+}
+
+func (c *testConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dc := query.Get("dc")
+	wait, _ := time.ParseDuration(query.Get("wait"))
+	if wait <= 0 {
+		wait = time.Minute
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	c.mu.Lock()
+	c.requests = append(c.requests, r)
+	for blocking := true; blocking && query.Get("index") == strconv.FormatUint(c.index[dc], 10); {
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			blocking = false
+		case <-r.Context().Done():
+			return
+		}
+		c.mu.Lock()
+	}
+	failing, index, instances := c.failing[dc], c.index[dc], c.instances[dc]
+	c.mu.Unlock()
 
-	updates, err := w.Next()
+	if failing {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if instances == "" {
+		instances = "[]"
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	w.Write([]byte(instances))
+}
+
+// newTestResolver creates a Resolver for the "service" service of c.
+func newTestResolver(t *testing.T, c *testConsul, path string, options ...ResolverOption) (*httptest.Server, *testClientConn, resolver.Resolver) {
+	t.Helper()
+	srv := httptest.NewServer(c)
+	client, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want, have := 2, len(updates); want != have {
-		t.Fatalf("retrieve updates via Next(): want %d, have %d", want, have)
+	u, err := url.Parse("consul://" + path)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if updates[0].Addr != "192.168.1.100:16384" && updates[0].Addr != "192.168.1.101:16385" {
-		t.Fatalf("1st update Addr: have %q", updates[0].Addr)
+	cc := newTestClientConn()
+	r, err := NewBuilder(client, options...).Build(resolver.Target{URL: *u}, cc, resolver.BuildOptions{})
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
 	}
-	if want, have := naming.Add, updates[0].Op; want != have {
-		t.Fatalf("1st update Op: want %v, have %v", want, have)
+	return srv, cc, r
+}
+
+// waitForAddr waits for the next state pushed to cc and checks that it
+// contains addr only.
+func (cc *testClientConn) waitForAddr(t *testing.T, addr string) {
+	t.Helper()
+	state := cc.waitForState(t)
+	if len(state.Addresses) != 1 || state.Addresses[0].Addr != addr {
+		t.Fatalf("want %s, have %v", addr, state.Addresses)
 	}
-	if updates[1].Addr != "192.168.1.100:16384" && updates[1].Addr != "192.168.1.101:16385" {
-		t.Fatalf("2nd update Addr: have %q", updates[1].Addr)
+}
+
+func TestResolverQueryOptions(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	c := newTestConsul()
+	c.set("dc1", "10.0.1.1")
+	srv, cc, r := newTestResolver(t, c, "/service?tag=prod",
+		SetDatacenter("dc1"),
+		SetNamespace("team-a"),
+		SetPartition("part-a"),
+		SetToken("secret"),
+		SetFilter(`Service.Meta.version == "2"`),
+		SetNear("_agent"),
+	)
+	defer srv.Close()
+	defer r.Close()
+	cc.waitForAddr(t, "10.0.1.1:9000")
+
+	req := c.lastRequest("dc1")
+	if want, have := "/v1/health/service/service", req.URL.Path; want != have {
+		t.Errorf("path: want %q, have %q", want, have)
 	}
-	if want, have := naming.Add, updates[1].Op; want != have {
-		t.Fatalf("2nd update Op: want %v, have %v", want, have)
+	tests := []struct {
+		Param string
+		Want  string
+	}{
+		{"tag", "prod"},
+		{"passing", "1"},
+		{"ns", "team-a"},
+		{"partition", "part-a"},
+		{"filter", `Service.Meta.version == "2"`},
+		{"near", "_agent"},
 	}
+	for _, tt := range tests {
+		if want, have := tt.Want, req.URL.Query().Get(tt.Param); want != have {
+			t.Errorf("%s: want %q, have %q", tt.Param, want, have)
+		}
+	}
+	if want, have := "secret", req.Header.Get("X-Consul-Token"); want != have {
+		t.Errorf("token: want %q, have %q", want, have)
+	}
+}
+
+func TestResolverFailover(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	c := newTestConsul()
+	c.set("dc1", "")
+	c.set("dc2", "10.0.2.1")
+	c.set("dc3", "10.0.3.1")
+	srv, cc, r := newTestResolver(t, c, "/service",
+		SetDatacenter("dc1"),
+		SetFailoverDatacenters("dc2", "dc3"),
+		SetWaitTime(10*time.Second),
+		SetFailoverWaitTime(50*time.Millisecond),
+		SetMinQueryInterval(0),
+	)
+	defer srv.Close()
+	defer r.Close()
+
+	// No healthy instances in dc1, so use the first failover datacenter
+	cc.waitForAddr(t, "10.0.2.1:9000")
+
+	// Changes in dc2 are picked up within the failover wait time, as the
+	// blocking query against dc1 doesn't return on changes in dc2
+	c.set("dc2", "10.0.2.2")
+	cc.waitForAddr(t, "10.0.2.2:9000")
+	if want, have := "50ms", c.lastRequest("dc1").URL.Query().Get("wait"); want != have {
+		t.Errorf("wait time in failover: want %q, have %q", want, have)
+	}
+
+	// Fail back as soon as dc1 has healthy instances again
+	c.set("dc1", "10.0.1.1")
+	cc.waitForAddr(t, "10.0.1.1:9000")
+	deadline := time.Now().Add(5 * time.Second)
+	for c.lastRequest("dc1").URL.Query().Get("wait") != "10000ms" {
+		if time.Now().After(deadline) {
+			t.Fatalf("wait time after failback: want %q, have %q", "10000ms", c.lastRequest("dc1").URL.Query().Get("wait"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResolverFailoverOnError(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	c := newTestConsul()
+	c.fail("dc1")
+	c.set("dc2", "10.0.2.1")
+	srv, cc, r := newTestResolver(t, c, "/service",
+		SetDatacenter("dc1"),
+		SetFailoverDatacenters("dc2"),
+		SetBackoff(10*time.Millisecond, 10*time.Millisecond),
+		SetMinQueryInterval(0),
+	)
+	defer srv.Close()
+	defer r.Close()
+
+	// dc1 fails, so use the failover datacenter without reporting an error
+	cc.waitForAddr(t, "10.0.2.1:9000")
+	select {
+	case err := <-cc.errc:
+		t.Fatalf("unexpected error while in failover: %v", err)
+	default:
+	}
+
+	// Fail back as soon as dc1 works again
+	c.set("dc1", "10.0.1.1")
+	cc.waitForAddr(t, "10.0.1.1:9000")
 }
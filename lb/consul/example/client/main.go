@@ -10,47 +10,35 @@ import (
 	"log"
 	"time"
 
-	"github.com/hashicorp/consul/api"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 
-	lb "github.com/olivere/grpc/lb/consul"
+	_ "github.com/olivere/grpc/lb/consul" // registers the consul:// scheme
 	pb "github.com/olivere/grpc/lb/consul/example/proto/echo"
+	_ "github.com/olivere/grpc/lb/leastrequest" // registers the least_request and p2c balancers
+	_ "github.com/olivere/grpc/lb/outlier"      // registers the outlier_detection balancer
+	_ "github.com/olivere/grpc/lb/weighted"     // registers the smooth_weighted_round_robin balancer
 )
 
 func main() {
 	var (
 		n = flag.Int("n", 0, "Number of calls to service")
 		t = flag.Duration("t", 1*time.Second, "Sleep interval between calls")
+		b = flag.String("balancer", "round_robin", "Balancer to use, e.g. round_robin, p2c or outlier_detection")
 	)
 	flag.Parse()
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	// Lookup service in Consul
-	cli, err := api.NewClient(api.DefaultConfig())
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Resolver for the "echo" service
-	r, err := lb.NewResolver(cli, "echo", "")
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	// Dial options
 	var opts []grpc.DialOption
-	opts = append(opts, grpc.WithInsecure())
-	// Enabling WithBlock tells the client to not give up trying to find a server
-	opts = append(opts, grpc.WithBlock())
-	// However, we're still setting a timeout so that if the server takes too long, we still give up
-	opts = append(opts, grpc.WithTimeout(10*time.Second))
-	// Add resolver with RoundRobin balancer here
-	opts = append(opts, grpc.WithBalancer(grpc.RoundRobin(r)))
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	// Use the given balancer for the addresses resolved from Consul
+	opts = append(opts, grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{%q:{}}]}`, *b)))
 
-	// Notice the blank address
-	conn, err := grpc.Dial("", opts...)
+	// Resolve the "echo" service via the local Consul agent
+	conn, err := grpc.NewClient("consul:///echo", opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
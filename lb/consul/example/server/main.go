@@ -9,23 +9,27 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/olivere/randport"
-	"github.com/satori/go.uuid"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
+	"github.com/olivere/grpc/lb/consul"
 	pb "github.com/olivere/grpc/lb/consul/example/proto/echo"
+	"github.com/olivere/grpc/lb/healthsrv"
 )
 
 func main() {
 	var (
-		addr = flag.String("addr", "", "gRPC address to bind to (default: 127.0.0.1:<random>)")
+		addr       = flag.String("addr", "", "gRPC address to bind to (default: 127.0.0.1:<random>)")
+		healthAddr = flag.String("health-addr", "", "HTTP address to serve /healthz on (default: disabled)")
+		drain      = flag.Duration("drain", 2*time.Second, "Time to wait for clients to stop sending RPCs before stopping")
 	)
 	flag.Parse()
 
@@ -34,15 +38,6 @@ func main() {
 	if len(*addr) == 0 {
 		*addr = fmt.Sprintf("127.0.0.1:%d", randport.Get())
 	}
-	address, portstr, err := net.SplitHostPort(*addr)
-	if err != nil {
-		log.Fatal(err)
-	}
-	port, err := strconv.Atoi(portstr)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	log.Printf("Binding to %s", *addr)
 
 	lis, err := net.Listen("tcp", *addr)
@@ -50,34 +45,45 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Register service with Consul
+	var opts []grpc.ServerOption
+	// Add e.g. TLS config or credentials here
+	// opts = append(opts, grpc.Creds(...))
+
+	srv := grpc.NewServer(opts...)
+	pb.RegisterEchoServer(srv, newServer())
+	hs := healthsrv.NewServer()
+	hs.Register(srv)
+
+	// Serve the health status via HTTP, e.g. for the healthz resolver
+	if *healthAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", hs)
+		go func() {
+			log.Fatal(http.ListenAndServe(*healthAddr, mux))
+		}()
+	}
+
+	// Register service with Consul. The registration has a TTL check that
+	// turns critical if the process dies, so Consul removes it eventually.
 	cli, err := api.NewClient(api.DefaultConfig())
 	if err != nil {
 		log.Fatal(err)
 	}
-	reg := &api.AgentServiceRegistration{
-		ID:      fmt.Sprintf("echo-%s", uuid.NewV4().String()),
-		Name:    "echo",
-		Tags:    []string{},
-		Address: address,
-		Port:    port,
-	}
-	err = cli.Agent().ServiceRegister(reg)
+	reg, err := consul.NewRegistrar(cli, srv, lis, "echo",
+		consul.SetHealthServer(hs.HealthServer(), ""),
+		consul.SetDrainWindow(*drain),
+	)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer cli.Agent().ServiceDeregister(reg.ID)
+	if err := reg.Register(); err != nil {
+		log.Fatal(err)
+	}
 
 	errc := make(chan error, 1)
 
-	// Create and serve gRPC server
+	// Serve gRPC server
 	go func() {
-		var opts []grpc.ServerOption
-		// Add e.g. TLS config or credentials here
-		// opts = append(opts, grpc.Creds(...))
-
-		srv := grpc.NewServer(opts...)
-		pb.RegisterEchoServer(srv, newServer())
 		errc <- srv.Serve(lis)
 	}()
 
@@ -89,11 +95,28 @@ func main() {
 		errc <- nil
 	}()
 
-	if err := <-errc; err != nil {
+	err = <-errc
+
+	// Drain, deregister from Consul, and stop the server
+	log.Printf("Draining for %v", *drain)
+	if err := shutdown(reg, hs); err != nil {
+		log.Printf("error deregistering from Consul: %v", err)
+	}
+	if err != nil {
 		log.Fatal(err)
-	} else {
-		log.Println("Done")
 	}
+	log.Println("Done")
+}
+
+// shutdown stops the server without failing RPCs: It reports the server
+// as draining on its health endpoints and puts it into maintenance mode
+// in Consul, so clients stop sending new RPCs. After the drain window,
+// it deregisters the server from Consul, and stops it gracefully, i.e.
+// after the RPCs in flight are finished.
+func shutdown(reg *consul.Registrar, hs *healthsrv.Server) error {
+	hs.Drain()
+	defer hs.Close()
+	return reg.GracefulStop()
 }
 
 // -- Server implementation --
@@ -0,0 +1,82 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package consul
+
+import (
+	"google.golang.org/grpc/resolver"
+)
+
+// metadataKey is the key for Metadata in the balancer attributes
+// of a resolver.Address.
+type metadataKey struct{}
+
+// Metadata contains the information Consul returns about an instance
+// of a service. The Resolver attaches it to every address it resolves,
+// so that custom pickers can route by tags, service or node metadata.
+// Use MetadataFromAddress to retrieve it.
+type Metadata struct {
+	ServiceID  string            // ID of the service instance
+	Tags       []string          // Service.Tags
+	Meta       map[string]string // Service.Meta
+	Datacenter string            // Node.Datacenter
+	NodeMeta   map[string]string // Node.Meta
+}
+
+// HasTag returns true if the instance is registered with the given tag.
+func (m Metadata) HasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Equal returns true if m and o are equal. It is used by gRPC to
+// compare addresses.
+func (m Metadata) Equal(o interface{}) bool {
+	om, ok := o.(Metadata)
+	if !ok {
+		return false
+	}
+	if m.ServiceID != om.ServiceID || m.Datacenter != om.Datacenter {
+		return false
+	}
+	if len(m.Tags) != len(om.Tags) {
+		return false
+	}
+	for i := range m.Tags {
+		if m.Tags[i] != om.Tags[i] {
+			return false
+		}
+	}
+	return equalMaps(m.Meta, om.Meta) && equalMaps(m.NodeMeta, om.NodeMeta)
+}
+
+// equalMaps returns true if a and b contain the same keys and values.
+func equalMaps(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// setMetadata returns a copy of addr with md attached.
+func setMetadata(addr resolver.Address, md Metadata) resolver.Address {
+	addr.BalancerAttributes = addr.BalancerAttributes.WithValue(metadataKey{}, md)
+	return addr
+}
+
+// MetadataFromAddress returns the Metadata the Resolver attached to addr.
+// It returns false if addr has not been resolved via Consul.
+func MetadataFromAddress(addr resolver.Address) (Metadata, bool) {
+	md, ok := addr.BalancerAttributes.Value(metadataKey{}).(Metadata)
+	return md, ok
+}
@@ -0,0 +1,69 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package consul
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/resolver"
+)
+
+func TestMetadataFromAddress(t *testing.T) {
+	if _, ok := MetadataFromAddress(resolver.Address{Addr: "127.0.0.1:1000"}); ok {
+		t.Fatal("expected no Metadata")
+	}
+
+	addr := setMetadata(resolver.Address{Addr: "127.0.0.1:1000"}, Metadata{
+		ServiceID:  "service-1",
+		Tags:       []string{"production", "v2"},
+		Meta:       map[string]string{"version": "2.0.1"},
+		Datacenter: "dc1",
+		NodeMeta:   map[string]string{"zone": "eu-west-1a"},
+	})
+	md, ok := MetadataFromAddress(addr)
+	if !ok {
+		t.Fatal("expected Metadata")
+	}
+	if want, have := "service-1", md.ServiceID; want != have {
+		t.Errorf("ServiceID: want %q, have %q", want, have)
+	}
+	if !md.HasTag("v2") {
+		t.Errorf("HasTag(%q): want true, have false", "v2")
+	}
+	if md.HasTag("canary") {
+		t.Errorf("HasTag(%q): want false, have true", "canary")
+	}
+	if want, have := "2.0.1", md.Meta["version"]; want != have {
+		t.Errorf("Meta: want %q, have %q", want, have)
+	}
+	if want, have := "dc1", md.Datacenter; want != have {
+		t.Errorf("Datacenter: want %q, have %q", want, have)
+	}
+	if want, have := "eu-west-1a", md.NodeMeta["zone"]; want != have {
+		t.Errorf("NodeMeta: want %q, have %q", want, have)
+	}
+}
+
+func TestMetadataEqual(t *testing.T) {
+	a := Metadata{Tags: []string{"v1"}, Meta: map[string]string{"k": "v"}}
+	b := Metadata{Tags: []string{"v1"}, Meta: map[string]string{"k": "v"}}
+	if !a.Equal(b) {
+		t.Errorf("want %+v to equal %+v", a, b)
+	}
+	b.Meta = map[string]string{"k": "w"}
+	if a.Equal(b) {
+		t.Errorf("want %+v to not equal %+v", a, b)
+	}
+	if a.Equal("v1") {
+		t.Errorf("want %+v to not equal a string", a)
+	}
+
+	// Addresses with equal Metadata must be equal for gRPC
+	x := setMetadata(resolver.Address{Addr: "127.0.0.1:1000"}, a)
+	y := setMetadata(resolver.Address{Addr: "127.0.0.1:1000"}, Metadata{Tags: []string{"v1"}, Meta: map[string]string{"k": "v"}})
+	if !x.Equal(y) {
+		t.Errorf("want address %v to equal %v", x, y)
+	}
+}
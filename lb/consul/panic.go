@@ -0,0 +1,59 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package consul
+
+import (
+	"log"
+	"sync/atomic"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// SetPanicThreshold enables the panic mode of the Resolver, like the
+// panic routing of Envoy. If the percentage of instances that pass the
+// health filter drops below the given threshold, e.g. 50 for 50%, the
+// Resolver pushes all instances of the service to the ClientConn,
+// regardless of their health. Instances in maintenance mode are never
+// used. This keeps the clients working if e.g. the health checks fail
+// for reasons that don't affect gRPC.
+//
+// Failover datacenters take precedence: The Resolver only falls back to
+// the panic mode if no failover datacenter has healthy instances. The
+// Resolver logs when it enters and leaves the panic mode, see Panicking.
+// The panic mode is disabled by default.
+func SetPanicThreshold(percent float64) ResolverOption {
+	return func(r *Resolver) error {
+		r.panicThreshold = percent
+		return nil
+	}
+}
+
+// Panicking returns true if the Resolver is in panic mode,
+// see SetPanicThreshold.
+func (r *Resolver) Panicking() bool {
+	return atomic.LoadInt32(&r.panicking) == 1
+}
+
+// applyPanicThreshold returns all instances if the Resolver is in panic
+// mode, and the healthy instances otherwise. It logs when the Resolver
+// enters or leaves the panic mode.
+func (r *Resolver) applyPanicThreshold(healthy, all []resolver.Address) []resolver.Address {
+	if r.panicThreshold <= 0 || len(all) == 0 {
+		atomic.StoreInt32(&r.panicking, 0)
+		return healthy
+	}
+	panicking := float64(len(healthy))*100 < r.panicThreshold*float64(len(all))
+	if panicking && !r.Panicking() {
+		log.Printf("grpc/lb/consul: entering panic mode with %d of %d instances healthy, using all instances", len(healthy), len(all))
+	} else if !panicking && r.Panicking() {
+		log.Printf("grpc/lb/consul: leaving panic mode with %d of %d instances healthy", len(healthy), len(all))
+	}
+	if panicking {
+		atomic.StoreInt32(&r.panicking, 1)
+		return all
+	}
+	atomic.StoreInt32(&r.panicking, 0)
+	return healthy
+}
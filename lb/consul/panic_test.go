@@ -0,0 +1,104 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package consul
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestApplyPanicThreshold(t *testing.T) {
+	entry := func(addr, status string) *api.ServiceEntry {
+		return &api.ServiceEntry{
+			Node:    &api.Node{Node: "node-" + addr, Address: addr},
+			Service: &api.AgentService{ID: "service-" + addr, Service: "service", Port: 9000},
+			Checks:  api.HealthChecks{{CheckID: "service:" + addr, Status: status}},
+		}
+	}
+	maint := entry("10.0.0.4", api.HealthPassing)
+	maint.Checks = append(maint.Checks, &api.HealthCheck{CheckID: api.NodeMaint, Status: api.HealthCritical})
+
+	tests := []struct {
+		Threshold float64
+		Services  []*api.ServiceEntry
+		Addrs     string
+		Panicking bool
+	}{
+		{
+			Threshold: 0,
+			Services:  []*api.ServiceEntry{entry("10.0.0.1", api.HealthPassing), entry("10.0.0.2", api.HealthCritical)},
+			Addrs:     "[10.0.0.1:9000]",
+			Panicking: false,
+		},
+		{
+			Threshold: 50,
+			Services:  []*api.ServiceEntry{entry("10.0.0.1", api.HealthPassing), entry("10.0.0.2", api.HealthCritical)},
+			Addrs:     "[10.0.0.1:9000]",
+			Panicking: false,
+		},
+		{
+			Threshold: 60,
+			Services:  []*api.ServiceEntry{entry("10.0.0.1", api.HealthPassing), entry("10.0.0.2", api.HealthCritical)},
+			Addrs:     "[10.0.0.1:9000 10.0.0.2:9000]",
+			Panicking: true,
+		},
+		{
+			Threshold: 1,
+			Services:  []*api.ServiceEntry{entry("10.0.0.2", api.HealthCritical), entry("10.0.0.3", api.HealthWarning)},
+			Addrs:     "[10.0.0.2:9000 10.0.0.3:9000]",
+			Panicking: true,
+		},
+		// Instances in maintenance mode are never used
+		{
+			Threshold: 100,
+			Services:  []*api.ServiceEntry{entry("10.0.0.1", api.HealthPassing), entry("10.0.0.2", api.HealthCritical), maint},
+			Addrs:     "[10.0.0.1:9000 10.0.0.2:9000]",
+			Panicking: true,
+		},
+		{
+			Threshold: 50,
+			Services:  []*api.ServiceEntry{maint},
+			Addrs:     "[]",
+			Panicking: false,
+		},
+	}
+	for i, tt := range tests {
+		r := &Resolver{}
+		if err := SetPanicThreshold(tt.Threshold)(r); err != nil {
+			t.Fatal(err)
+		}
+		var addrs []string
+		for _, addr := range r.applyPanicThreshold(r.makeInstances(tt.Services)) {
+			addrs = append(addrs, addr.Addr)
+		}
+		if want, have := tt.Addrs, fmt.Sprint(addrs); want != have {
+			t.Errorf("#%d: want %s, have %s", i, want, have)
+		}
+		if want, have := tt.Panicking, r.Panicking(); want != have {
+			t.Errorf("#%d: Panicking: want %v, have %v", i, want, have)
+		}
+	}
+}
+
+func TestApplyPanicThresholdLeavesPanicMode(t *testing.T) {
+	r := &Resolver{panicThreshold: 50}
+	all := []resolver.Address{{Addr: "10.0.0.1:9000"}, {Addr: "10.0.0.2:9000"}}
+
+	if want, have := 2, len(r.applyPanicThreshold(nil, all)); want != have {
+		t.Fatalf("want %d addresses, have %d", want, have)
+	}
+	if !r.Panicking() {
+		t.Fatal("want Resolver in panic mode")
+	}
+	if want, have := 1, len(r.applyPanicThreshold(all[:1], all)); want != have {
+		t.Fatalf("want %d addresses, have %d", want, have)
+	}
+	if r.Panicking() {
+		t.Fatal("want Resolver not in panic mode")
+	}
+}
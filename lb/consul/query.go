@@ -0,0 +1,124 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package consul
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/olivere/grpc/lb/internal/resolverutil"
+)
+
+var (
+	defaultQueryInterval = 10 * time.Second
+
+	// ErrPreparedQueryOption is returned when a prepared query is combined
+	// with options that the prepared query defines itself, i.e. a service,
+	// tag, filter, or failover datacenters.
+	ErrPreparedQueryOption = errors.New("service, tag, filter and failover datacenters are defined by the prepared query")
+)
+
+// SetPreparedQuery tells the Resolver to execute the prepared query with
+// the given name or ID instead of looking up the service directly. This
+// allows to define e.g. the failover policy in Consul.
+//
+// The instances are returned in the order of the query results, e.g.
+// sorted by round trip time if the query specifies a Near node. The health
+// filter and check options are applied to the results of the query as well.
+// Notice that prepared queries don't support blocking queries, so the
+// Resolver executes the query periodically, see SetQueryInterval.
+//
+// The service, tag, filter, and failover datacenters are part of the
+// prepared query, so the Resolver returns ErrPreparedQueryOption if they
+// are specified as well. SetWaitTime, SetFailoverWaitTime,
+// SetMinQueryInterval, and SetBackoff don't apply to prepared queries:
+// the Resolver executes the query every query interval, also after errors.
+func SetPreparedQuery(nameOrID string) ResolverOption {
+	return func(r *Resolver) error {
+		r.preparedQuery = nameOrID
+		return nil
+	}
+}
+
+// SetQueryInterval specifies the interval in which to execute the
+// prepared query. It defaults to 10 seconds.
+func SetQueryInterval(interval time.Duration) ResolverOption {
+	return func(r *Resolver) error {
+		r.queryInterval = interval
+		return nil
+	}
+}
+
+// queryUpdater is a background process started in newResolver if the
+// Resolver executes a prepared query. It takes the list of previously
+// resolved instances, and whether they have been pushed to the ClientConn
+// already.
+func (r *Resolver) queryUpdater(instances []resolver.Address, updated bool) {
+	defer r.wg.Done()
+
+	t := time.NewTicker(r.queryInterval)
+	defer t.Stop()
+
+	var oldInstances = instances
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-t.C:
+			newInstances, err := r.executeQuery()
+			if r.ctx.Err() != nil {
+				// Resolver has been closed
+				return
+			}
+			if err != nil {
+				resolverutil.ReportError(r.cc, "grpc/lb/consul: error executing prepared query", err)
+				continue
+			}
+			// The order matters, e.g. for the pick_first balancer if the
+			// query sorts the instances by round trip time
+			if !updated || !equalOrder(oldInstances, newInstances) {
+				r.updateState(newInstances)
+				updated = true
+			}
+			oldInstances = newInstances
+		}
+	}
+}
+
+// equalOrder returns true if a and b contain the same instances in the
+// same order.
+func equalOrder(a, b []resolver.Address) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// executeQuery executes the prepared query and returns the instances.
+func (r *Resolver) executeQuery() ([]resolver.Address, error) {
+	res, _, err := r.c.PreparedQuery().Execute(r.preparedQuery, (&api.QueryOptions{
+		Datacenter: r.datacenter,
+		Namespace:  r.namespace,
+		Partition:  r.partition,
+		Token:      r.token,
+		Near:       r.near,
+	}).WithContext(r.ctx))
+	if err != nil {
+		return nil, err
+	}
+	services := make([]*api.ServiceEntry, len(res.Nodes))
+	for i := range res.Nodes {
+		services[i] = &res.Nodes[i]
+	}
+	return r.applyPanicThreshold(r.makeInstances(services)), nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package consul
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/testutil"
+
+	"google.golang.org/grpc/resolver"
+)
+
+func TestResolverWithPreparedQuery(t *testing.T) {
+	srv, err := testutil.NewTestServerConfigT(t, func(c *testutil.TestServerConfig) {
+		c.Stdout = ioutil.Discard
+		c.Stderr = ioutil.Discard
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: srv.HTTPAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		ID:      "service-1",
+		Name:    "service",
+		Address: "192.168.1.100",
+		Port:    16384,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		ID:      "service-2",
+		Name:    "service",
+		Address: "192.168.1.101",
+		Port:    16385,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.PreparedQuery().Create(&api.PreparedQueryDefinition{
+		Name: "service-query",
+		Service: api.ServiceQuery{
+			Service:     "service",
+			OnlyPassing: true,
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse("consul:///?query=service-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := newTestClientConn()
+	r, err := NewBuilder(client, SetQueryInterval(250*time.Millisecond)).Build(resolver.Target{URL: *u}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	state := cc.waitForState(t)
+	if want, have := 2, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+
+	// Deregister service-2, and we should receive the remaining address
+	if err := client.Agent().ServiceDeregister("service-2"); err != nil {
+		t.Fatal(err)
+	}
+	state = cc.waitForState(t)
+	if want, have := 1, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+	if want, have := "192.168.1.100:16384", state.Addresses[0].Addr; want != have {
+		t.Fatalf("1st Addr: want %q, have %q", want, have)
+	}
+}
+
+func TestResolverWithPreparedQueryOrder(t *testing.T) {
+	// srv returns no instances at first, then two instances sorted by
+	// round trip time, and then the same instances in reverse order
+	var queries int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node := func(addr string) string {
+			return fmt.Sprintf(`{"Node":{"Address":%q},"Service":{"ID":%q,"Port":9000},"Checks":[]}`, addr, addr)
+		}
+		switch atomic.AddInt32(&queries, 1) {
+		case 1:
+			w.Write([]byte(`{"Nodes":[]}`))
+		case 2:
+			w.Write([]byte(`{"Nodes":[` + node("10.0.0.1") + `,` + node("10.0.0.2") + `]}`))
+		default:
+			w.Write([]byte(`{"Nodes":[` + node("10.0.0.2") + `,` + node("10.0.0.1") + `]}`))
+		}
+	}))
+	defer srv.Close()
+
+	client, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse("consul:///?query=service-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := newTestClientConn()
+	r, err := NewBuilder(client, SetNear("_agent"), SetQueryInterval(10*time.Millisecond)).Build(resolver.Target{URL: *u}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// The ClientConn must learn that there are no instances
+	if state := cc.waitForState(t); len(state.Addresses) != 0 {
+		t.Fatalf("want no addresses, have %v", state.Addresses)
+	}
+	for _, want := range []string{"[10.0.0.1:9000 10.0.0.2:9000]", "[10.0.0.2:9000 10.0.0.1:9000]"} {
+		state := cc.waitForState(t)
+		var addrs []string
+		for _, addr := range state.Addresses {
+			addrs = append(addrs, addr.Addr)
+		}
+		if have := fmt.Sprint(addrs); want != have {
+			t.Fatalf("want %s, have %s", want, have)
+		}
+	}
+
+	// The order doesn't change anymore, so there are no more updates
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case state := <-cc.statec:
+		t.Fatalf("unexpected state: %v", state.Addresses)
+	default:
+	}
+}
+
+func TestBuilderWithPreparedQueryOptions(t *testing.T) {
+	tests := []struct {
+		Target  string
+		Options []ResolverOption
+	}{
+		{"consul:///echo?query=echo-query", nil},
+		{"consul:///?query=echo-query&tag=prod", nil},
+		{"consul:///?query=echo-query", []ResolverOption{SetFilter(`Service.Meta.version == "2"`)}},
+		{"consul:///?query=echo-query", []ResolverOption{SetFailoverDatacenters("dc2")}},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.Target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewBuilder(nil, tt.Options...).Build(resolver.Target{URL: *u}, newTestClientConn(), resolver.BuildOptions{})
+		if want, have := ErrPreparedQueryOption, err; want != have {
+			t.Errorf("%s: want %v, have %v", tt.Target, want, have)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var (
+	defaultTTL                            = 10 * time.Second
+	defaultDeregisterCriticalServiceAfter = 1 * time.Minute
+
+	// ErrNoName is returned when a Registrar is created without a service name.
+	ErrNoName = errors.New("no service name specified")
+	// ErrRegistered is returned when registering a Registrar twice.
+	ErrRegistered = errors.New("service is already registered")
+)
+
+// Registrar registers a gRPC server as an instance of a service in Consul,
+// so clients can find it via the Resolver. Unlike a plain registration,
+// the instance has a health check: Either a TTL check that the Registrar
+// keeps passing while the server runs (the default), or a gRPC check that
+// Consul runs against the gRPC Health Checking Protocol of the server. If
+// the process dies, the check turns critical and Consul deregisters the
+// instance after a while, see SetDeregisterCriticalServiceAfter.
+//
+// Use Stop or GracefulStop instead of the methods of the gRPC server to
+// deregister the instance before the server stops. To restart servers
+// without failing RPCs, use SetDrainWindow, so clients stop sending
+// RPCs to the instance before GracefulStop stops the server.
+type Registrar struct {
+	c   *api.Client
+	srv *grpc.Server
+	reg *api.AgentServiceRegistration
+
+	ttl                            time.Duration
+	grpcInterval                   time.Duration
+	deregisterCriticalServiceAfter time.Duration
+	health                         *health.Server
+	healthService                  string
+	drainWindow                    time.Duration
+
+	mu         sync.Mutex
+	registered bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// RegistrarOption configures a Registrar.
+type RegistrarOption func(*Registrar) error
+
+// NewRegistrar creates a Registrar for srv, which serves on lis, as an
+// instance of the service with the given name. The address and port of
+// the instance are taken from lis. If lis listens on all interfaces, the
+// address of the Consul agent's node is used, see SetServiceAddress.
+//
+// Call Register to register the instance.
+func NewRegistrar(client *api.Client, srv *grpc.Server, lis net.Listener, name string, options ...RegistrarOption) (*Registrar, error) {
+	if name == "" {
+		return nil, ErrNoName
+	}
+	host, portstr, err := net.SplitHostPort(lis.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = ""
+	}
+	r := &Registrar{
+		c:   client,
+		srv: srv,
+		reg: &api.AgentServiceRegistration{
+			ID:      fmt.Sprintf("%s-%s", name, lis.Addr().String()),
+			Name:    name,
+			Address: host,
+			Port:    port,
+		},
+		ttl:                            defaultTTL,
+		deregisterCriticalServiceAfter: defaultDeregisterCriticalServiceAfter,
+	}
+	for _, option := range options {
+		if err := option(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// SetServiceID specifies the ID of the instance. It defaults to the name
+// of the service and the address of the listener, e.g. "echo-10.0.0.1:9000".
+func SetServiceID(id string) RegistrarOption {
+	return func(r *Registrar) error {
+		r.reg.ID = id
+		return nil
+	}
+}
+
+// SetServiceAddress specifies the address to register, e.g. if the
+// listener isn't reachable under its own address.
+func SetServiceAddress(addr string) RegistrarOption {
+	return func(r *Registrar) error {
+		r.reg.Address = addr
+		return nil
+	}
+}
+
+// SetServiceTags specifies the tags of the instance.
+func SetServiceTags(tags ...string) RegistrarOption {
+	return func(r *Registrar) error {
+		r.reg.Tags = tags
+		return nil
+	}
+}
+
+// SetServiceMeta specifies the metadata of the instance.
+func SetServiceMeta(meta map[string]string) RegistrarOption {
+	return func(r *Registrar) error {
+		r.reg.Meta = meta
+		return nil
+	}
+}
+
+// SetServiceWeights specifies the weights of the instance while its
+// checks are passing or warning, see package weighted.
+func SetServiceWeights(passing, warning int) RegistrarOption {
+	return func(r *Registrar) error {
+		r.reg.Weights = &api.AgentWeights{Passing: passing, Warning: warning}
+		return nil
+	}
+}
+
+// SetTTL specifies the TTL of the check of the instance. The Registrar
+// updates the check three times per TTL. It defaults to 10 seconds.
+func SetTTL(ttl time.Duration) RegistrarOption {
+	return func(r *Registrar) error {
+		if ttl <= 0 {
+			return fmt.Errorf("invalid TTL %v", ttl)
+		}
+		r.ttl = ttl
+		r.grpcInterval = 0
+		return nil
+	}
+}
+
+// SetGRPCCheck makes Consul check the instance via the gRPC Health
+// Checking Protocol in the given interval, instead of using a TTL check.
+// The gRPC server must serve grpc.health.v1.Health, see SetHealthServer.
+func SetGRPCCheck(interval time.Duration) RegistrarOption {
+	return func(r *Registrar) error {
+		if interval <= 0 {
+			return fmt.Errorf("invalid check interval %v", interval)
+		}
+		r.grpcInterval = interval
+		return nil
+	}
+}
+
+// SetHealthServer specifies the health server of the gRPC server, and
+// the service name to check, or an empty string for the server as a
+// whole. With a TTL check, the Registrar reports the status of the
+// service to Consul: SERVING as passing, and critical otherwise. With
+// a gRPC check, Consul checks the service itself. Stop and GracefulStop
+// shut the health server down.
+func SetHealthServer(hs *health.Server, service string) RegistrarOption {
+	return func(r *Registrar) error {
+		r.health = hs
+		r.healthService = service
+		return nil
+	}
+}
+
+// SetDeregisterCriticalServiceAfter specifies how long the check of the
+// instance may be critical before Consul deregisters the instance, e.g.
+// when the process died without deregistering. Use 0 to keep critical
+// instances. It defaults to 1 minute.
+func SetDeregisterCriticalServiceAfter(d time.Duration) RegistrarOption {
+	return func(r *Registrar) error {
+		r.deregisterCriticalServiceAfter = d
+		return nil
+	}
+}
+
+// SetDrainWindow makes GracefulStop drain the instance first, see Drain,
+// and then wait for the given duration before it deregisters the instance
+// and stops the gRPC server. Clients using the Resolver stop sending RPCs
+// to the instance once their blocking query returns, which usually takes
+// much less than a second. Use a longer window if clients use a minimum
+// query interval, see SetMinQueryInterval. It defaults to 0, i.e. no
+// drain window.
+func SetDrainWindow(d time.Duration) RegistrarOption {
+	return func(r *Registrar) error {
+		if d < 0 {
+			return fmt.Errorf("invalid drain window %v", d)
+		}
+		r.drainWindow = d
+		return nil
+	}
+}
+
+// ServiceID returns the ID of the instance in Consul.
+func (r *Registrar) ServiceID() string {
+	return r.reg.ID
+}
+
+// CheckID returns the ID of the check of the instance in Consul.
+func (r *Registrar) CheckID() string {
+	return "service:" + r.reg.ID
+}
+
+// Register registers the instance with the local Consul agent. With
+// a TTL check, it starts to update the check in the background. It
+// returns ErrRegistered if the instance is already registered.
+func (r *Registrar) Register() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.registered {
+		return ErrRegistered
+	}
+
+	reg := *r.reg
+	reg.Check = r.check()
+	if err := r.c.Agent().ServiceRegister(&reg); err != nil {
+		return err
+	}
+	r.registered = true
+	if r.grpcInterval > 0 {
+		return nil
+	}
+
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	if err := r.updateTTL(); err != nil {
+		log.Printf("grpc/lb/consul: error updating TTL of %s: %v", r.reg.ID, err)
+	}
+	r.wg.Add(1)
+	go r.heartbeat()
+	return nil
+}
+
+// check returns the check of the instance.
+func (r *Registrar) check() *api.AgentServiceCheck {
+	check := &api.AgentServiceCheck{
+		CheckID: r.CheckID(),
+		Name:    "gRPC health of " + r.reg.Name,
+	}
+	if r.deregisterCriticalServiceAfter > 0 {
+		check.DeregisterCriticalServiceAfter = r.deregisterCriticalServiceAfter.String()
+	}
+	if r.grpcInterval > 0 {
+		addr := r.reg.Address
+		if addr == "" {
+			addr = "127.0.0.1"
+		}
+		check.GRPC = net.JoinHostPort(addr, strconv.Itoa(r.reg.Port))
+		if r.healthService != "" {
+			check.GRPC += "/" + r.healthService
+		}
+		check.Interval = r.grpcInterval.String()
+		return check
+	}
+	check.TTL = r.ttl.String()
+	check.Status = api.HealthCritical
+	return check
+}
+
+// heartbeat updates the TTL check until the Registrar is deregistered.
+func (r *Registrar) heartbeat() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.updateTTL(); err != nil && r.ctx.Err() == nil {
+				log.Printf("grpc/lb/consul: error updating TTL of %s: %v", r.reg.ID, err)
+			}
+		}
+	}
+}
+
+// updateTTL updates the TTL check with the status of the health server,
+// or as passing if there is no health server.
+func (r *Registrar) updateTTL() error {
+	status, output := api.HealthPassing, "serving"
+	if r.health != nil {
+		res, err := r.health.Check(r.ctx, &healthpb.HealthCheckRequest{Service: r.healthService})
+		switch {
+		case err != nil:
+			status, output = api.HealthCritical, err.Error()
+		case res.Status != healthpb.HealthCheckResponse_SERVING:
+			status, output = api.HealthCritical, res.Status.String()
+		}
+	}
+	return r.c.Agent().UpdateTTLOpts(r.CheckID(), output, status, (&api.QueryOptions{}).WithContext(r.ctx))
+}
+
+// Deregister stops updating the TTL check, and deregisters the instance
+// from the local Consul agent. It is a no-op if the instance is not
+// registered.
+func (r *Registrar) Deregister() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.registered {
+		return nil
+	}
+	if r.cancel != nil {
+		r.cancel()
+		r.wg.Wait()
+		r.cancel = nil
+	}
+	r.registered = false
+	return r.c.Agent().ServiceDeregister(r.reg.ID)
+}
+
+// Drain puts the instance into maintenance mode with the given reason, so
+// the Resolver no longer returns it to clients, while the server still
+// serves RPCs in flight. It is a no-op if the instance is not registered.
+func (r *Registrar) Drain(reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.registered {
+		return nil
+	}
+	return r.c.Agent().EnableServiceMaintenance(r.reg.ID, reason)
+}
+
+// Resume ends the maintenance mode of the instance, see Drain. It is
+// a no-op if the instance is not registered.
+func (r *Registrar) Resume() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.registered {
+		return nil
+	}
+	return r.c.Agent().DisableServiceMaintenance(r.reg.ID)
+}
+
+// Stop deregisters the instance, shuts down the health server, and
+// stops the gRPC server, like grpc.Server.Stop.
+func (r *Registrar) Stop() error {
+	err := r.Deregister()
+	if r.health != nil {
+		r.health.Shutdown()
+	}
+	r.srv.Stop()
+	return err
+}
+
+// GracefulStop deregisters the instance, shuts down the health server,
+// and stops the gRPC server gracefully, like grpc.Server.GracefulStop.
+// With a drain window, see SetDrainWindow, it first drains the instance
+// and shuts down the health server, and waits for the drain window to
+// pass before it deregisters the instance.
+func (r *Registrar) GracefulStop() error {
+	if r.drainWindow > 0 {
+		if err := r.Drain("shutting down"); err != nil {
+			log.Printf("grpc/lb/consul: error draining %s: %v", r.reg.ID, err)
+		}
+		if r.health != nil {
+			r.health.Shutdown()
+		}
+		time.Sleep(r.drainWindow)
+	}
+	err := r.Deregister()
+	if r.health != nil {
+		r.health.Shutdown()
+	}
+	r.srv.GracefulStop()
+	return err
+}
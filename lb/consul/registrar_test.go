@@ -0,0 +1,333 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package consul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"go.uber.org/goleak"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// agentRequest is a request to the fake Consul agent.
+type agentRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Body   []byte
+}
+
+// startAgent starts a fake Consul agent that passes all requests to
+// the returned channel. It returns a client for the agent and a func
+// to stop it.
+func startAgent(t *testing.T) (*api.Client, <-chan agentRequest, func()) {
+	reqc := make(chan agentRequest, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		reqc <- agentRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query(), Body: body}
+	}))
+	client, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return client, reqc, srv.Close
+}
+
+// waitForRequest returns the next request to the fake Consul agent.
+func waitForRequest(t *testing.T, reqc <-chan agentRequest) agentRequest {
+	t.Helper()
+	select {
+	case req := <-reqc:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for request")
+	}
+	return agentRequest{}
+}
+
+func TestRegistrarWithTTL(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	client, reqc, stop := startAgent(t)
+	defer stop()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	srv := grpc.NewServer()
+	hs := health.NewServer()
+
+	r, err := NewRegistrar(client, srv, lis, "echo",
+		SetServiceTags("v1"),
+		SetTTL(300*time.Millisecond),
+		SetHealthServer(hs, "echo"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	if err := r.Register(); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := ErrRegistered, r.Register(); want != have {
+		t.Fatalf("Register twice: want %v, have %v", want, have)
+	}
+
+	req := waitForRequest(t, reqc)
+	if want, have := "/v1/agent/service/register", req.Path; want != have {
+		t.Fatalf("Path: want %q, have %q", want, have)
+	}
+	var reg api.AgentServiceRegistration
+	if err := json.Unmarshal(req.Body, &reg); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "echo-"+lis.Addr().String(), reg.ID; want != have {
+		t.Errorf("ID: want %q, have %q", want, have)
+	}
+	if want, have := "127.0.0.1", reg.Address; want != have {
+		t.Errorf("Address: want %q, have %q", want, have)
+	}
+	if want, have := lis.Addr().(*net.TCPAddr).Port, reg.Port; want != have {
+		t.Errorf("Port: want %d, have %d", want, have)
+	}
+	if want, have := 1, len(reg.Tags); want != have {
+		t.Fatalf("Tags: want %d, have %d", want, have)
+	}
+	if reg.Check == nil {
+		t.Fatal("want Check, have nil")
+	}
+	if want, have := "300ms", reg.Check.TTL; want != have {
+		t.Errorf("TTL: want %q, have %q", want, have)
+	}
+	if want, have := "1m0s", reg.Check.DeregisterCriticalServiceAfter; want != have {
+		t.Errorf("DeregisterCriticalServiceAfter: want %q, have %q", want, have)
+	}
+
+	// The TTL check reflects the status of the health server
+	waitForStatus := func(status string) {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			req := waitForRequest(t, reqc)
+			if want, have := "/v1/agent/check/update/"+r.CheckID(), req.Path; want != have {
+				t.Fatalf("Path: want %q, have %q", want, have)
+			}
+			var update struct{ Status string }
+			if err := json.Unmarshal(req.Body, &update); err != nil {
+				t.Fatal(err)
+			}
+			if update.Status == status {
+				return
+			}
+		}
+		t.Fatalf("timed out waiting for status %q", status)
+	}
+	waitForStatus(api.HealthPassing)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_NOT_SERVING)
+	waitForStatus(api.HealthCritical)
+
+	if err := r.GracefulStop(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		req := waitForRequest(t, reqc)
+		if req.Path == "/v1/agent/check/update/"+r.CheckID() {
+			// Update was in flight
+			continue
+		}
+		if want, have := "/v1/agent/service/deregister/"+r.ServiceID(), req.Path; want != have {
+			t.Fatalf("Path: want %q, have %q", want, have)
+		}
+		break
+	}
+
+	// No more updates after deregistration
+	select {
+	case req := <-reqc:
+		t.Fatalf("want no more requests, have %s %s", req.Method, req.Path)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestRegistrarWithGRPCCheck(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	client, reqc, stop := startAgent(t)
+	defer stop()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	srv := grpc.NewServer()
+
+	r, err := NewRegistrar(client, srv, lis, "echo",
+		SetServiceID("echo-1"),
+		SetGRPCCheck(5*time.Second),
+		SetHealthServer(health.NewServer(), "echo"),
+		SetDeregisterCriticalServiceAfter(0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := waitForRequest(t, reqc)
+	var reg api.AgentServiceRegistration
+	if err := json.Unmarshal(req.Body, &reg); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "echo-1", reg.ID; want != have {
+		t.Errorf("ID: want %q, have %q", want, have)
+	}
+	if want, have := lis.Addr().String()+"/echo", reg.Check.GRPC; want != have {
+		t.Errorf("GRPC: want %q, have %q", want, have)
+	}
+	if want, have := "5s", reg.Check.Interval; want != have {
+		t.Errorf("Interval: want %q, have %q", want, have)
+	}
+	if want, have := "", reg.Check.TTL; want != have {
+		t.Errorf("TTL: want %q, have %q", want, have)
+	}
+	if want, have := "", reg.Check.DeregisterCriticalServiceAfter; want != have {
+		t.Errorf("DeregisterCriticalServiceAfter: want %q, have %q", want, have)
+	}
+
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	req = waitForRequest(t, reqc)
+	if want, have := "/v1/agent/service/deregister/echo-1", req.Path; want != have {
+		t.Fatalf("Path: want %q, have %q", want, have)
+	}
+}
+
+func TestRegistrarDrain(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	client, reqc, stop := startAgent(t)
+	defer stop()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	srv := grpc.NewServer()
+	hs := health.NewServer()
+
+	r, err := NewRegistrar(client, srv, lis, "echo",
+		SetServiceID("echo-1"),
+		SetGRPCCheck(5*time.Second),
+		SetHealthServer(hs, ""),
+		SetDrainWindow(200*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Drain is a no-op before registering
+	if err := r.Drain("test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "/v1/agent/service/register", waitForRequest(t, reqc).Path; want != have {
+		t.Fatalf("Path: want %q, have %q", want, have)
+	}
+
+	if err := r.Drain("test"); err != nil {
+		t.Fatal(err)
+	}
+	req := waitForRequest(t, reqc)
+	if want, have := "/v1/agent/service/maintenance/echo-1", req.Path; want != have {
+		t.Fatalf("Path: want %q, have %q", want, have)
+	}
+	if want, have := "true", req.Query.Get("enable"); want != have {
+		t.Fatalf("enable: want %q, have %q", want, have)
+	}
+	if want, have := "test", req.Query.Get("reason"); want != have {
+		t.Fatalf("reason: want %q, have %q", want, have)
+	}
+	if err := r.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	req = waitForRequest(t, reqc)
+	if want, have := "false", req.Query.Get("enable"); want != have {
+		t.Fatalf("enable: want %q, have %q", want, have)
+	}
+
+	// GracefulStop drains, waits for the drain window, and deregisters
+	start := time.Now()
+	if err := r.GracefulStop(); err != nil {
+		t.Fatal(err)
+	}
+	req = waitForRequest(t, reqc)
+	if want, have := "/v1/agent/service/maintenance/echo-1", req.Path; want != have {
+		t.Fatalf("Path: want %q, have %q", want, have)
+	}
+	req = waitForRequest(t, reqc)
+	if want, have := "/v1/agent/service/deregister/echo-1", req.Path; want != have {
+		t.Fatalf("Path: want %q, have %q", want, have)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("want GracefulStop to wait for the drain window, have %v", elapsed)
+	}
+	res, err := hs.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := healthpb.HealthCheckResponse_NOT_SERVING, res.Status; want != have {
+		t.Fatalf("Status: want %v, have %v", want, have)
+	}
+}
+
+func TestNewRegistrar(t *testing.T) {
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	if _, err := NewRegistrar(nil, nil, lis, ""); err != ErrNoName {
+		t.Fatalf("want %v, have %v", ErrNoName, err)
+	}
+	if _, err := NewRegistrar(nil, nil, lis, "echo", SetTTL(0)); err == nil {
+		t.Fatal("want error, have nil")
+	}
+	if _, err := NewRegistrar(nil, nil, lis, "echo", SetDrainWindow(-1)); err == nil {
+		t.Fatal("want error, have nil")
+	}
+
+	// Listeners on all interfaces use the address of the node
+	r, err := NewRegistrar(nil, nil, lis, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "", r.reg.Address; want != have {
+		t.Errorf("Address: want %q, have %q", want, have)
+	}
+	r, err = NewRegistrar(nil, nil, lis, "echo", SetServiceAddress("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "10.0.0.1", r.reg.Address; want != have {
+		t.Errorf("Address: want %q, have %q", want, have)
+	}
+}
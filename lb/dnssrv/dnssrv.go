@@ -0,0 +1,470 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+// Package dnssrv implements a gRPC resolver that resolves services
+// via DNS SRV records, e.g. _echo._tcp.example.com, as served by
+// many DNS servers, including the DNS interface of Consul.
+package dnssrv
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/olivere/grpc/lb/internal/resolverutil"
+	"github.com/olivere/grpc/lb/weighted"
+)
+
+// Scheme is the scheme the Builder is registered with in gRPC.
+// Use e.g. "dnssrv:///_echo._tcp.example.com" as a target to resolve
+// the SRV records of _echo._tcp.example.com via the nameserver of the
+// system, or "dnssrv://127.0.0.1:8600/echo.service.consul" to resolve
+// the "echo" service via the DNS interface of a local Consul agent.
+const Scheme = "dnssrv"
+
+var (
+	defaultMinRefreshInterval = 5 * time.Second
+	defaultTimeout            = 5 * time.Second
+	defaultBackoffBase        = 1 * time.Second
+	defaultBackoffMax         = 2 * time.Minute
+	defaultResolvConf         = "/etc/resolv.conf"
+
+	// weightScale is the factor the SRV weights are multiplied by before
+	// they are split across the addresses of their targets.
+	weightScale uint32 = 100
+
+	// ErrNoName is returned when the target does not specify a name.
+	ErrNoName = errors.New("no name specified")
+	// ErrNoNameserver is returned when no nameserver is configured.
+	ErrNoNameserver = errors.New("no nameserver configured")
+)
+
+func init() {
+	resolver.Register(NewBuilder())
+}
+
+// Name returns the name of the SRV records of the given service,
+// protocol, and domain, e.g. Name("echo", "tcp", "example.com")
+// returns "_echo._tcp.example.com.".
+func Name(service, proto, domain string) string {
+	return dns.Fqdn(fmt.Sprintf("_%s._%s.%s", service, proto, domain))
+}
+
+// Builder implements the gRPC resolver.Builder interface. It creates
+// a Resolver for targets of the form dnssrv://[nameserver]/name. If the
+// nameserver has no port, port 53 is used.
+type Builder struct {
+	options []ResolverOption
+}
+
+// NewBuilder initializes and returns a new Builder. The options are
+// applied to every Resolver created by the Builder. Use it together with
+// grpc.WithResolvers if you need to pass options.
+func NewBuilder(options ...ResolverOption) *Builder {
+	return &Builder{options: options}
+}
+
+// Scheme returns the scheme supported by the Builder.
+func (b *Builder) Scheme() string {
+	return Scheme
+}
+
+// Build creates a new Resolver for the given target.
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	options := append([]ResolverOption{}, b.options...)
+	if addr := nameserverOf(target); addr != "" {
+		options = append(options, SetNameserver(addr))
+	}
+	return newResolver(cc, target.Endpoint(), options...)
+}
+
+// nameserverOf returns the address of the nameserver in the authority
+// of target, with port 53 if it has no port, or "" if there is none.
+func nameserverOf(target resolver.Target) string {
+	host := target.URL.Hostname()
+	if host == "" {
+		return ""
+	}
+	port := target.URL.Port()
+	if port == "" {
+		port = "53"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Record contains the fields of the SRV record an address has been
+// resolved from. The Resolver attaches it to every address, so that
+// custom pickers can e.g. prefer addresses with a lower priority.
+// Use RecordFromAddress to retrieve it.
+type Record struct {
+	Target   string // Target host, e.g. "host1.example.com."
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+}
+
+// recordKey is the key for Record in the balancer attributes
+// of a resolver.Address.
+type recordKey struct{}
+
+// setRecord returns a copy of addr with rec attached.
+func setRecord(addr resolver.Address, rec Record) resolver.Address {
+	addr.BalancerAttributes = addr.BalancerAttributes.WithValue(recordKey{}, rec)
+	return addr
+}
+
+// RecordFromAddress returns the Record the Resolver attached to addr.
+// It returns false if addr has not been resolved via DNS SRV records.
+func RecordFromAddress(addr resolver.Address) (Record, bool) {
+	rec, ok := addr.BalancerAttributes.Value(recordKey{}).(Record)
+	return rec, ok
+}
+
+// Resolver implements the gRPC Resolver interface using DNS SRV records.
+// It resolves the records again when their TTL expires, but not more
+// often than the minimum refresh interval, and pushes the current list
+// of addresses to the gRPC ClientConn whenever it changes.
+//
+// Every address has a weight attached (see package weighted), as well as
+// its SRV Record, see RecordFromAddress. The weight of a record is split
+// across the addresses of its target, so a target with two addresses gets
+// as many RPCs as one with a single address. Records with weight 0 get
+// the smallest weight, so they are picked rarely, as RFC 2782 recommends
+// when other records have a weight. If the name doesn't exist or has no
+// records, the Resolver pushes an empty list of addresses, so RPCs fail
+// instead of waiting for records to appear.
+type Resolver struct {
+	cc         resolver.ClientConn
+	name       string
+	nameserver string
+
+	minRefreshInterval time.Duration
+	timeout            time.Duration
+	backoffBase        time.Duration
+	backoffMax         time.Duration
+
+	resolveNow chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// ResolverOption is a callback for setting the options of the Resolver.
+type ResolverOption func(*Resolver) error
+
+// newResolver initializes and returns a new Resolver for the SRV
+// records with the given name.
+func newResolver(cc resolver.ClientConn, name string, options ...ResolverOption) (*Resolver, error) {
+	r := &Resolver{
+		cc:                 cc,
+		name:               dns.Fqdn(name),
+		minRefreshInterval: defaultMinRefreshInterval,
+		timeout:            defaultTimeout,
+		backoffBase:        defaultBackoffBase,
+		backoffMax:         defaultBackoffMax,
+		resolveNow:         make(chan struct{}, 1),
+	}
+	for _, option := range options {
+		if err := option(r); err != nil {
+			return nil, err
+		}
+	}
+	if name == "" {
+		return nil, ErrNoName
+	}
+	if r.nameserver == "" {
+		cfg, err := dns.ClientConfigFromFile(defaultResolvConf)
+		if err != nil {
+			return nil, err
+		}
+		if len(cfg.Servers) == 0 {
+			return nil, ErrNoNameserver
+		}
+		r.nameserver = net.JoinHostPort(cfg.Servers[0], cfg.Port)
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	// Resolve immediately
+	addrs, ttl, err := r.lookup()
+	if err != nil {
+		resolverutil.ReportError(r.cc, "grpc/lb/dnssrv: error resolving "+r.name, err)
+	} else {
+		r.updateState(addrs)
+	}
+
+	// Start updater
+	r.wg.Add(1)
+	go r.updater(addrs, ttl, err)
+
+	return r, nil
+}
+
+// SetNameserver specifies the address of the nameserver to query,
+// e.g. "127.0.0.1:8600". It defaults to the first nameserver in
+// /etc/resolv.conf.
+func SetNameserver(addr string) ResolverOption {
+	return func(r *Resolver) error {
+		r.nameserver = addr
+		return nil
+	}
+}
+
+// SetMinRefreshInterval specifies the minimum duration between two
+// lookups, so that records with a low TTL, e.g. 0 as served by Consul
+// by default, don't overwhelm the nameserver. It defaults to 5 seconds.
+func SetMinRefreshInterval(interval time.Duration) ResolverOption {
+	return func(r *Resolver) error {
+		r.minRefreshInterval = interval
+		return nil
+	}
+}
+
+// SetTimeout specifies the timeout of a single DNS query.
+// It defaults to 5 seconds.
+func SetTimeout(timeout time.Duration) ResolverOption {
+	return func(r *Resolver) error {
+		r.timeout = timeout
+		return nil
+	}
+}
+
+// SetBackoff specifies the exponential backoff after failed lookups.
+// The first retry happens after base, then the duration doubles with every
+// failure up to max. A random jitter of up to 50% is subtracted from every
+// duration. It defaults to 1 second and 2 minutes respectively.
+func SetBackoff(base, max time.Duration) ResolverOption {
+	return func(r *Resolver) error {
+		r.backoffBase = base
+		r.backoffMax = max
+		return nil
+	}
+}
+
+// ResolveNow resolves the records again, without waiting for their TTL
+// to expire. The minimum refresh interval still applies.
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+// Close closes the resolver. It cancels all outstanding queries and
+// waits for the background process to finish, so the ClientConn receives
+// no more updates after Close returns. It is safe to call Close more
+// than once.
+func (r *Resolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// updater is a background process started in newResolver. It takes the
+// result of the first lookup, and resolves the records again when their
+// TTL expires or ResolveNow is called.
+func (r *Resolver) updater(addrs []resolver.Address, ttl time.Duration, err error) {
+	defer r.wg.Done()
+
+	var oldAddrs = addrs
+	var newAddrs []resolver.Address
+	var lastQuery = time.Now()
+	var updated = err == nil // true once addrs have been pushed
+	var retries int
+	if err != nil {
+		retries = 1
+	}
+
+	for {
+		delay := ttl
+		if retries > 0 {
+			delay = resolverutil.Backoff(r.backoffBase, r.backoffMax, retries)
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-r.ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		case <-r.resolveNow:
+			t.Stop()
+		}
+
+		// Don't overwhelm the nameserver
+		if !resolverutil.Wait(r.ctx, r.minRefreshInterval-time.Since(lastQuery)) {
+			return
+		}
+		lastQuery = time.Now()
+
+		newAddrs, ttl, err = r.lookup()
+		if r.ctx.Err() != nil {
+			// Resolver has been closed
+			return
+		}
+		if err != nil {
+			resolverutil.ReportError(r.cc, "grpc/lb/dnssrv: error resolving "+r.name, err)
+			retries++
+			continue
+		}
+		retries = 0
+
+		added, deleted := resolverutil.MakeUpdates(oldAddrs, newAddrs)
+		if !updated || len(added) > 0 || len(deleted) > 0 {
+			r.updateState(newAddrs)
+			updated = true
+		}
+		oldAddrs = newAddrs
+	}
+}
+
+// updateState pushes the given list of addresses to the ClientConn.
+func (r *Resolver) updateState(addrs []resolver.Address) {
+	r.cc.UpdateState(resolver.State{Addresses: addrs})
+}
+
+// lookup resolves the SRV records and the addresses of their targets.
+// It returns the addresses, and the duration after which to resolve
+// them again, i.e. the lowest TTL of all records involved, but at
+// least the minimum refresh interval. If the name doesn't exist, it
+// returns no addresses and no error.
+func (r *Resolver) lookup() ([]resolver.Address, time.Duration, error) {
+	in, err := r.query(r.name, dns.TypeSRV)
+	if err != nil {
+		return nil, r.minRefreshInterval, err
+	}
+	if in.Rcode == dns.RcodeNameError {
+		return nil, r.minRefreshInterval, nil
+	}
+
+	ttl := ^uint32(0)
+	hosts := make(map[string][]net.IP)
+	for _, rr := range in.Extra {
+		if ip, ok := ipOf(rr); ok {
+			host := strings.ToLower(rr.Header().Name)
+			hosts[host] = append(hosts[host], ip)
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+
+	var addrs []resolver.Address
+	for _, rr := range in.Answer {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		if srv.Hdr.Ttl < ttl {
+			ttl = srv.Hdr.Ttl
+		}
+		if srv.Target == "." {
+			// The service is decidedly not available at this domain
+			continue
+		}
+		target := strings.ToLower(srv.Target)
+		ips, found := hosts[target]
+		if !found {
+			var hostTTL uint32
+			ips, hostTTL, err = r.lookupHost(target)
+			if err != nil {
+				return nil, r.minRefreshInterval, err
+			}
+			hosts[target] = ips
+			if hostTTL < ttl {
+				ttl = hostTTL
+			}
+		}
+		weight := addressWeight(srv.Weight, len(ips))
+		for _, ip := range ips {
+			addr := resolver.Address{Addr: net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.Port)))}
+			addr = setRecord(addr, Record{
+				Target:   srv.Target,
+				Port:     srv.Port,
+				Priority: srv.Priority,
+				Weight:   srv.Weight,
+			})
+			addr = weighted.SetWeight(addr, weight)
+			addrs = append(addrs, addr)
+		}
+	}
+
+	refresh := time.Duration(ttl) * time.Second
+	if len(addrs) == 0 || refresh < r.minRefreshInterval {
+		refresh = r.minRefreshInterval
+	}
+	return addrs, refresh, nil
+}
+
+// addressWeight returns the weight of each of the n addresses of a target
+// with the given SRV weight, i.e. the scaled weight split evenly, but at
+// least 1.
+func addressWeight(srvWeight uint16, n int) uint32 {
+	weight := uint32(srvWeight) * weightScale / uint32(n)
+	if weight == 0 {
+		return 1
+	}
+	return weight
+}
+
+// lookupHost resolves the IPv4 and IPv6 addresses of host. It returns
+// the addresses and their lowest TTL.
+func (r *Resolver) lookupHost(host string) ([]net.IP, uint32, error) {
+	var ips []net.IP
+	ttl := ^uint32(0)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		in, err := r.query(host, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, rr := range in.Answer {
+			if ip, ok := ipOf(rr); ok {
+				ips = append(ips, ip)
+				if rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+				}
+			}
+		}
+	}
+	return ips, ttl, nil
+}
+
+// query sends a query for name and qtype to the nameserver. It retries
+// via TCP if the response is truncated. It returns an error if the
+// nameserver fails, but not if the name doesn't exist.
+func (r *Resolver) query(name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+
+	ctx, cancel := context.WithTimeout(r.ctx, r.timeout)
+	defer cancel()
+	in, _, err := (&dns.Client{Net: "udp"}).ExchangeContext(ctx, msg, r.nameserver)
+	if err == nil && in.Truncated {
+		in, _, err = (&dns.Client{Net: "tcp"}).ExchangeContext(ctx, msg, r.nameserver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("query for %s failed: %s", name, dns.RcodeToString[in.Rcode])
+	}
+	return in, nil
+}
+
+// ipOf returns the IP address of an A or AAAA record.
+func ipOf(rr dns.RR) (net.IP, bool) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A, true
+	case *dns.AAAA:
+		return rr.AAAA, true
+	}
+	return nil, false
+}
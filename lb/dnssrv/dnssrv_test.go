@@ -0,0 +1,485 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package dnssrv
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/olivere/grpc/lb/weighted"
+)
+
+// testClientConn implements resolver.ClientConn and records the
+// states pushed by the Resolver.
+type testClientConn struct {
+	resolver.ClientConn // unimplemented methods panic
+
+	statec chan resolver.State
+	errc   chan error
+}
+
+func newTestClientConn() *testClientConn {
+	return &testClientConn{
+		statec: make(chan resolver.State, 10),
+		errc:   make(chan error, 10),
+	}
+}
+
+func (cc *testClientConn) UpdateState(state resolver.State) error {
+	cc.statec <- state
+	return nil
+}
+
+func (cc *testClientConn) ReportError(err error) {
+	select {
+	case cc.errc <- err:
+	default:
+	}
+}
+
+// waitForState waits for the next state pushed to cc.
+func (cc *testClientConn) waitForState(t *testing.T) resolver.State {
+	t.Helper()
+	select {
+	case state := <-cc.statec:
+		return state
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for resolver state")
+	}
+	return resolver.State{}
+}
+
+// testServer is an in-process DNS server that serves the records
+// set via set.
+type testServer struct {
+	srv *dns.Server
+
+	mu      sync.Mutex
+	records map[uint16][]dns.RR // by query type
+	extra   []dns.RR            // additional records of SRV responses
+	rcode   int
+	queries int
+}
+
+// startServer starts a testServer on a random UDP port.
+func startServer(t *testing.T) *testServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{records: make(map[uint16][]dns.RR)}
+	started := make(chan struct{})
+	s.srv = &dns.Server{
+		PacketConn:        pc,
+		Handler:           dns.HandlerFunc(s.serveDNS),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go s.srv.ActivateAndServe()
+	<-started
+	return s
+}
+
+// Addr returns the address of the server.
+func (s *testServer) Addr() string {
+	return s.srv.PacketConn.LocalAddr().String()
+}
+
+// Close stops the server.
+func (s *testServer) Close() {
+	s.srv.Shutdown()
+}
+
+// set replaces the records of the server. Every record is given in
+// zone file format, e.g. "host1.example.com. 60 IN A 10.0.0.1". Records
+// prefixed with "+" are returned as additional records of SRV responses.
+func (s *testServer) set(t *testing.T, records ...string) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = make(map[uint16][]dns.RR)
+	s.extra = nil
+	for _, record := range records {
+		extra := record[0] == '+'
+		if extra {
+			record = record[1:]
+		}
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if extra {
+			s.extra = append(s.extra, rr)
+		} else {
+			s.records[rr.Header().Rrtype] = append(s.records[rr.Header().Rrtype], rr)
+		}
+	}
+}
+
+// setRcode makes the server respond with the given response code.
+func (s *testServer) setRcode(rcode int) {
+	s.mu.Lock()
+	s.rcode = rcode
+	s.mu.Unlock()
+}
+
+// numQueries returns the number of SRV queries the server received.
+func (s *testServer) numQueries() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries
+}
+
+func (s *testServer) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := req.Question[0]
+	res := new(dns.Msg)
+	res.SetReply(req)
+	if q.Qtype == dns.TypeSRV {
+		s.queries++
+	}
+	if s.rcode != dns.RcodeSuccess {
+		res.SetRcode(req, s.rcode)
+		w.WriteMsg(res)
+		return
+	}
+	var found bool
+	for _, rrs := range s.records {
+		for _, rr := range rrs {
+			if rr.Header().Name != q.Name {
+				continue
+			}
+			found = true
+			if rr.Header().Rrtype == q.Qtype {
+				res.Answer = append(res.Answer, rr)
+			}
+		}
+	}
+	if !found {
+		res.SetRcode(req, dns.RcodeNameError)
+	}
+	if q.Qtype == dns.TypeSRV && len(res.Answer) > 0 {
+		res.Extra = s.extra
+	}
+	w.WriteMsg(res)
+}
+
+// addrs returns the sorted addresses of state.
+func addrs(state resolver.State) []string {
+	var list []string
+	for _, addr := range state.Addresses {
+		list = append(list, addr.Addr)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func TestResolver(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s := startServer(t)
+	defer s.Close()
+	s.set(t,
+		"_echo._tcp.example.com. 60 IN SRV 10 3 9000 host1.example.com.",
+		"_echo._tcp.example.com. 60 IN SRV 20 1 9001 host2.example.com.",
+		"+host1.example.com. 60 IN A 10.0.0.1",
+		"host2.example.com. 60 IN A 10.0.0.2",
+		"host2.example.com. 60 IN AAAA ::1",
+	)
+
+	cc := newTestClientConn()
+	r, err := newResolver(cc, "_echo._tcp.example.com", SetNameserver(s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	state := cc.waitForState(t)
+	if want, have := "[10.0.0.1:9000 10.0.0.2:9001 [::1]:9001]", fmt.Sprint(addrs(state)); want != have {
+		t.Fatalf("Addresses: want %s, have %s", want, have)
+	}
+	for _, addr := range state.Addresses {
+		rec, ok := RecordFromAddress(addr)
+		if !ok {
+			t.Fatalf("%s: want Record, have none", addr.Addr)
+		}
+		var want Record
+		if addr.Addr == "10.0.0.1:9000" {
+			want = Record{Target: "host1.example.com.", Port: 9000, Priority: 10, Weight: 3}
+		} else {
+			want = Record{Target: "host2.example.com.", Port: 9001, Priority: 20, Weight: 1}
+		}
+		if want != rec {
+			t.Errorf("%s: Record: want %+v, have %+v", addr.Addr, want, rec)
+		}
+	}
+	// host2.example.com. splits its weight across its two addresses
+	weights := make(map[string]uint32)
+	for _, addr := range state.Addresses {
+		weights[addr.Addr] = weighted.Weight(addr)
+	}
+	if want, have := "map[10.0.0.1:9000:300 10.0.0.2:9001:50 [::1]:9001:50]", fmt.Sprint(weights); want != have {
+		t.Errorf("Weights: want %s, have %s", want, have)
+	}
+}
+
+func TestAddressWeight(t *testing.T) {
+	tests := []struct {
+		SRVWeight uint16
+		N         int
+		Want      uint32
+	}{
+		{1, 1, 100},
+		{1, 2, 50},
+		{3, 3, 100},
+		{65535, 1, 6553500},
+		{1, 1000, 1},
+		{0, 1, 1},
+		{0, 2, 1},
+	}
+	for _, tt := range tests {
+		if have := addressWeight(tt.SRVWeight, tt.N); tt.Want != have {
+			t.Errorf("addressWeight(%d, %d): want %d, have %d", tt.SRVWeight, tt.N, tt.Want, have)
+		}
+	}
+}
+
+func TestResolverRefreshesAfterTTL(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s := startServer(t)
+	defer s.Close()
+	s.set(t,
+		"_echo._tcp.example.com. 1 IN SRV 10 1 9000 host1.example.com.",
+		"+host1.example.com. 60 IN A 10.0.0.1",
+	)
+
+	cc := newTestClientConn()
+	r, err := newResolver(cc, "_echo._tcp.example.com",
+		SetNameserver(s.Addr()),
+		SetMinRefreshInterval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	state := cc.waitForState(t)
+	if want, have := "[10.0.0.1:9000]", fmt.Sprint(addrs(state)); want != have {
+		t.Fatalf("Addresses: want %s, have %s", want, have)
+	}
+
+	// The Resolver picks up the new records after the TTL of 1s expired
+	start := time.Now()
+	s.set(t,
+		"_echo._tcp.example.com. 1 IN SRV 10 1 9000 host1.example.com.",
+		"_echo._tcp.example.com. 1 IN SRV 10 1 9000 host2.example.com.",
+		"+host1.example.com. 60 IN A 10.0.0.1",
+		"+host2.example.com. 60 IN A 10.0.0.2",
+	)
+	state = cc.waitForState(t)
+	if want, have := "[10.0.0.1:9000 10.0.0.2:9000]", fmt.Sprint(addrs(state)); want != have {
+		t.Fatalf("Addresses: want %s, have %s", want, have)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("want update after TTL, have %v", elapsed)
+	}
+
+	// Unchanged records don't push a new state
+	select {
+	case state := <-cc.statec:
+		t.Fatalf("want no update, have %v", addrs(state))
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+func TestResolverMinRefreshInterval(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s := startServer(t)
+	defer s.Close()
+	s.set(t,
+		"_echo._tcp.example.com. 0 IN SRV 10 1 9000 host1.example.com.",
+		"+host1.example.com. 0 IN A 10.0.0.1",
+	)
+
+	cc := newTestClientConn()
+	r, err := newResolver(cc, "_echo._tcp.example.com",
+		SetNameserver(s.Addr()),
+		SetMinRefreshInterval(200*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	cc.waitForState(t)
+
+	// ResolveNow doesn't bypass the minimum refresh interval
+	for i := 0; i < 10; i++ {
+		r.ResolveNow(resolver.ResolveNowOptions{})
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := s.numQueries(); n < 2 || n > 5 {
+		t.Fatalf("want 2-5 queries in 500ms, have %d", n)
+	}
+}
+
+func TestResolverNameError(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s := startServer(t)
+	defer s.Close()
+
+	cc := newTestClientConn()
+	r, err := newResolver(cc, "_echo._tcp.example.com",
+		SetNameserver(s.Addr()),
+		SetMinRefreshInterval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// A name that doesn't exist is not an error, but there are no addresses
+	state := cc.waitForState(t)
+	if want, have := 0, len(state.Addresses); want != have {
+		t.Fatalf("Addresses: want %d, have %d", want, have)
+	}
+	select {
+	case err := <-cc.errc:
+		t.Fatalf("want no error, have %v", err)
+	default:
+	}
+
+	s.set(t,
+		"_echo._tcp.example.com. 60 IN SRV 10 1 9000 host1.example.com.",
+		"+host1.example.com. 60 IN A 10.0.0.1",
+	)
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	state = cc.waitForState(t)
+	if want, have := "[10.0.0.1:9000]", fmt.Sprint(addrs(state)); want != have {
+		t.Fatalf("Addresses: want %s, have %s", want, have)
+	}
+
+	// Records that disappear are removed
+	s.set(t)
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	state = cc.waitForState(t)
+	if want, have := 0, len(state.Addresses); want != have {
+		t.Fatalf("Addresses: want %d, have %d", want, have)
+	}
+}
+
+func TestResolverReportsErrors(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s := startServer(t)
+	defer s.Close()
+	s.setRcode(dns.RcodeServerFailure)
+
+	cc := newTestClientConn()
+	r, err := newResolver(cc, "_echo._tcp.example.com",
+		SetNameserver(s.Addr()),
+		SetMinRefreshInterval(10*time.Millisecond),
+		SetBackoff(10*time.Millisecond, 10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	select {
+	case <-cc.errc:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for error")
+	}
+
+	// The Resolver retries after a backoff, and pushes the result even
+	// if there are no records
+	s.setRcode(dns.RcodeSuccess)
+	state := cc.waitForState(t)
+	if want, have := 0, len(state.Addresses); want != have {
+		t.Fatalf("Addresses: want %d, have %d", want, have)
+	}
+	s.set(t,
+		"_echo._tcp.example.com. 60 IN SRV 10 1 9000 host1.example.com.",
+		"+host1.example.com. 60 IN A 10.0.0.1",
+	)
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	state = cc.waitForState(t)
+	if want, have := "[10.0.0.1:9000]", fmt.Sprint(addrs(state)); want != have {
+		t.Fatalf("Addresses: want %s, have %s", want, have)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s := startServer(t)
+	defer s.Close()
+	s.set(t,
+		"_echo._tcp.example.com. 60 IN SRV 10 1 9000 host1.example.com.",
+		"+host1.example.com. 60 IN A 10.0.0.1",
+	)
+
+	u, err := url.Parse("dnssrv://" + s.Addr() + "/_echo._tcp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := newTestClientConn()
+	r, err := NewBuilder().Build(resolver.Target{URL: *u}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	state := cc.waitForState(t)
+	if want, have := "[10.0.0.1:9000]", fmt.Sprint(addrs(state)); want != have {
+		t.Fatalf("Addresses: want %s, have %s", want, have)
+	}
+
+	_, err = NewBuilder().Build(resolver.Target{URL: url.URL{Scheme: Scheme, Host: s.Addr(), Path: "/"}}, cc, resolver.BuildOptions{})
+	if want, have := ErrNoName, err; want != have {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+}
+
+func TestNameserverOf(t *testing.T) {
+	tests := []struct {
+		Target string
+		Want   string
+	}{
+		{"dnssrv:///_echo._tcp.example.com", ""},
+		{"dnssrv://127.0.0.1/_echo._tcp.example.com", "127.0.0.1:53"},
+		{"dnssrv://127.0.0.1:8600/echo.service.consul", "127.0.0.1:8600"},
+		{"dnssrv://[::1]/_echo._tcp.example.com", "[::1]:53"},
+		{"dnssrv://[::1]:8600/echo.service.consul", "[::1]:8600"},
+		{"dnssrv://ns1.example.com/_echo._tcp.example.com", "ns1.example.com:53"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.Target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := tt.Want, nameserverOf(resolver.Target{URL: *u}); want != have {
+			t.Errorf("%s: want %q, have %q", tt.Target, want, have)
+		}
+	}
+}
+
+func TestName(t *testing.T) {
+	if want, have := "_echo._tcp.example.com.", Name("echo", "tcp", "example.com"); want != have {
+		t.Fatalf("want %q, have %q", want, have)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package healthsrv
+
+import (
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// CheckFunc checks a dependency of the server, e.g. a database. It returns
+// nil if the dependency is available.
+type CheckFunc func(ctx context.Context) error
+
+// AddCheck adds a dependency check with the given name. While the check
+// fails, all services report NOT_SERVING, so clients stop sending RPCs
+// that would fail anyway. The check runs once before AddCheck returns,
+// and then in the interval given by SetCheckInterval until Close is
+// called. The name of every check must be unique.
+func (s *Server) AddCheck(name string, check CheckFunc) {
+	if s.ctx.Err() != nil {
+		return
+	}
+	s.runCheck(name, check)
+	s.wg.Add(1)
+	go s.watchCheck(name, check)
+}
+
+// watchCheck runs check periodically until the server is closed.
+func (s *Server) watchCheck(name string, check CheckFunc) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.runCheck(name, check)
+		}
+	}
+}
+
+// runCheck runs check and updates the status of the server if its
+// result changed.
+func (s *Server) runCheck(name string, check CheckFunc) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.checkTimeout)
+	err := check(ctx)
+	cancel()
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, found := s.checks[name]
+	s.checks[name] = err
+	switch {
+	case err != nil && (!found || prev == nil):
+		log.Printf("grpc/lb/healthsrv: dependency %s failed: %v", name, err)
+		s.update()
+	case err == nil && found && prev != nil:
+		log.Printf("grpc/lb/healthsrv: dependency %s recovered", name)
+		s.update()
+	}
+}
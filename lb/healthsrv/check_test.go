@@ -0,0 +1,82 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package healthsrv
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"golang.org/x/net/context"
+)
+
+func TestAddCheck(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s := NewServer(SetCheckInterval(10 * time.Millisecond))
+	defer s.Close()
+
+	var failing int32 = 1
+	s.AddCheck("db", func(ctx context.Context) error {
+		if atomic.LoadInt32(&failing) == 1 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+
+	// The first check runs before AddCheck returns
+	code, res := get(t, s, "")
+	if want, have := http.StatusServiceUnavailable, code; want != have {
+		t.Fatalf("Code: want %d, have %d", want, have)
+	}
+	if want, have := "connection refused", res.Checks["db"]; want != have {
+		t.Fatalf("Checks: want %q, have %q", want, have)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, res = get(t, s, "")
+		if code == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for dependency to recover")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if want, have := "ok", res.Checks["db"]; want != have {
+		t.Fatalf("Checks: want %q, have %q", want, have)
+	}
+}
+
+func TestAddCheckTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s := NewServer(SetCheckTimeout(10 * time.Millisecond))
+	defer s.Close()
+
+	s.AddCheck("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if code, _ := get(t, s, ""); code != http.StatusServiceUnavailable {
+		t.Fatalf("Code: want %d, have %d", http.StatusServiceUnavailable, code)
+	}
+}
+
+func TestAddCheckAfterClose(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s := NewServer()
+	s.Close()
+	s.AddCheck("db", func(ctx context.Context) error {
+		t.Fatal("want no check after Close")
+		return nil
+	})
+}
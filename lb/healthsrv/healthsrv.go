@@ -0,0 +1,248 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+// Package healthsrv implements the server side of health checks for gRPC
+// servers, as checked by the healthz and consul resolvers.
+//
+// A Server keeps the health status of a gRPC server and its services. It
+// exposes the status both via HTTP, e.g. as the CheckURL of a healthz
+// Endpoint, and via the gRPC Health Checking Protocol, so both kinds of
+// health checks always agree. A service is healthy if its status is
+// SERVING, all dependency checks pass (see AddCheck), and the server is
+// not draining (see Drain).
+//
+// Example:
+//
+//	hs := healthsrv.NewServer()
+//	defer hs.Close()
+//	hs.AddCheck("db", func(ctx context.Context) error { return db.PingContext(ctx) })
+//	hs.Register(grpcServer)
+//	http.Handle("/healthz", hs)
+//
+// Before shutting down, call Drain so clients stop sending RPCs, wait for
+// the clients to notice, and then stop the gRPC server gracefully. Use
+// GracefulStop together with SetDrainWindow to do all of this.
+package healthsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var (
+	defaultCheckInterval = 10 * time.Second
+	defaultCheckTimeout  = 5 * time.Second
+)
+
+// Server keeps the health status of a gRPC server and its services.
+// It implements http.Handler, and serves grpc.health.v1.Health via
+// Register. The zero value is not usable, use NewServer.
+type Server struct {
+	grpc          *health.Server
+	checkInterval time.Duration
+	checkTimeout  time.Duration
+	drainWindow   time.Duration
+
+	mu       sync.Mutex
+	statuses map[string]healthpb.HealthCheckResponse_ServingStatus
+	draining bool
+	checks   map[string]error // last result of every dependency check
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// SetCheckInterval specifies the interval of the dependency checks.
+// It defaults to 10 seconds.
+func SetCheckInterval(d time.Duration) Option {
+	return func(s *Server) {
+		s.checkInterval = d
+	}
+}
+
+// SetCheckTimeout specifies the timeout of every dependency check.
+// It defaults to 5 seconds.
+func SetCheckTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.checkTimeout = d
+	}
+}
+
+// SetDrainWindow specifies how long GracefulStop waits after draining
+// before it stops the gRPC server. It should be longer than the interval
+// in which clients check the server, see healthz.SetUpdateInterval.
+// It defaults to 0, i.e. no drain window.
+func SetDrainWindow(d time.Duration) Option {
+	return func(s *Server) {
+		s.drainWindow = d
+	}
+}
+
+// NewServer creates a new Server. The server as a whole, i.e. the
+// empty service name, is SERVING initially.
+func NewServer(options ...Option) *Server {
+	s := &Server{
+		grpc:          health.NewServer(),
+		checkInterval: defaultCheckInterval,
+		checkTimeout:  defaultCheckTimeout,
+		statuses: map[string]healthpb.HealthCheckResponse_ServingStatus{
+			"": healthpb.HealthCheckResponse_SERVING,
+		},
+		checks: make(map[string]error),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// Register registers the grpc.health.v1.Health service with srv.
+func (s *Server) Register(srv *grpc.Server) {
+	healthpb.RegisterHealthServer(srv, s.grpc)
+}
+
+// HealthServer returns the gRPC health server, e.g. to pass it to
+// consul.SetHealthServer.
+func (s *Server) HealthServer() *health.Server {
+	return s.grpc
+}
+
+// SetServingStatus sets the status of a service, or of the server as
+// a whole if service is empty.
+func (s *Server) SetServingStatus(service string, status healthpb.HealthCheckResponse_ServingStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[service] = status
+	s.update()
+}
+
+// Status returns the status of a service, including the dependency
+// checks and drain mode. It returns false if the service is unknown.
+func (s *Server) Status(service string) (healthpb.HealthCheckResponse_ServingStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.statuses[service]; !found {
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, false
+	}
+	return s.status(service), true
+}
+
+// Drain puts the server into drain mode: All services report NOT_SERVING,
+// and the HTTP handler returns 503, so clients stop sending new RPCs.
+func (s *Server) Drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+	s.update()
+}
+
+// Resume ends the drain mode.
+func (s *Server) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = false
+	s.update()
+}
+
+// Draining returns true if the server is in drain mode.
+func (s *Server) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// status returns the status of service. The caller must hold s.mu.
+func (s *Server) status(service string) healthpb.HealthCheckResponse_ServingStatus {
+	if s.draining {
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	for _, err := range s.checks {
+		if err != nil {
+			return healthpb.HealthCheckResponse_NOT_SERVING
+		}
+	}
+	return s.statuses[service]
+}
+
+// update passes the status of all services to the gRPC health server.
+// The caller must hold s.mu.
+func (s *Server) update() {
+	for service := range s.statuses {
+		s.grpc.SetServingStatus(service, s.status(service))
+	}
+}
+
+// response is the body of an HTTP response of the Server.
+type response struct {
+	Status   string            `json:"status"`
+	Draining bool              `json:"draining,omitempty"`
+	Checks   map[string]string `json:"checks,omitempty"`
+}
+
+// ServeHTTP reports the status of the service given in the "service"
+// query parameter, or of the server as a whole. It returns 200 if the
+// service is SERVING, 503 if not, and 404 if the service is unknown.
+// The body contains the status and the results of the dependency checks
+// as JSON, e.g.:
+//
+//	{"status":"NOT_SERVING","checks":{"db":"dial tcp 10.0.0.1:5432: connection refused"}}
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	service := r.URL.Query().Get("service")
+
+	s.mu.Lock()
+	_, found := s.statuses[service]
+	status := s.status(service)
+	res := response{Status: status.String(), Draining: s.draining}
+	if len(s.checks) > 0 {
+		res.Checks = make(map[string]string, len(s.checks))
+		for name, err := range s.checks {
+			if err != nil {
+				res.Checks[name] = err.Error()
+			} else {
+				res.Checks[name] = "ok"
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	code := http.StatusOK
+	switch {
+	case !found:
+		code = http.StatusNotFound
+		res.Status = healthpb.HealthCheckResponse_SERVICE_UNKNOWN.String()
+	case status != healthpb.HealthCheckResponse_SERVING:
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
+
+// GracefulStop drains the server, waits for the drain window to pass, see
+// SetDrainWindow, and then stops srv gracefully and closes the Server.
+func (s *Server) GracefulStop(srv *grpc.Server) {
+	s.Drain()
+	time.Sleep(s.drainWindow)
+	srv.GracefulStop()
+	s.Close()
+}
+
+// Close stops all dependency checks.
+func (s *Server) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
@@ -0,0 +1,203 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package healthsrv
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// get requests the status of service from h, and returns the status
+// code and the decoded body.
+func get(t *testing.T, h http.Handler, service string) (int, response) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/healthz?service="+service, nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var res response
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, res
+}
+
+func TestServeHTTP(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	s.SetServingStatus("admin", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	tests := []struct {
+		Service string
+		Code    int
+		Status  string
+	}{
+		{"", http.StatusOK, "SERVING"},
+		{"echo", http.StatusOK, "SERVING"},
+		{"admin", http.StatusServiceUnavailable, "NOT_SERVING"},
+		{"unknown", http.StatusNotFound, "SERVICE_UNKNOWN"},
+	}
+	for i, tt := range tests {
+		code, res := get(t, s, tt.Service)
+		if want, have := tt.Code, code; want != have {
+			t.Errorf("#%d: Code: want %d, have %d", i, want, have)
+		}
+		if want, have := tt.Status, res.Status; want != have {
+			t.Errorf("#%d: Status: want %q, have %q", i, want, have)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+
+	s.Drain()
+	if !s.Draining() {
+		t.Fatal("want Draining, have not")
+	}
+	for _, service := range []string{"", "echo"} {
+		code, res := get(t, s, service)
+		if want, have := http.StatusServiceUnavailable, code; want != have {
+			t.Errorf("%q: Code: want %d, have %d", service, want, have)
+		}
+		if !res.Draining {
+			t.Errorf("%q: want draining in response, have not", service)
+		}
+		status, found := s.Status(service)
+		if want, have := healthpb.HealthCheckResponse_NOT_SERVING, status; !found || want != have {
+			t.Errorf("%q: Status: want %v, have %v (found=%v)", service, want, have, found)
+		}
+	}
+
+	// Services added while draining are NOT_SERVING as well
+	s.SetServingStatus("admin", healthpb.HealthCheckResponse_SERVING)
+	if code, _ := get(t, s, "admin"); code != http.StatusServiceUnavailable {
+		t.Errorf("Code: want %d, have %d", http.StatusServiceUnavailable, code)
+	}
+
+	s.Resume()
+	if s.Draining() {
+		t.Fatal("want not Draining, have Draining")
+	}
+	for _, service := range []string{"", "echo", "admin"} {
+		if code, _ := get(t, s, service); code != http.StatusOK {
+			t.Errorf("%q: Code: want %d, have %d", service, http.StatusOK, code)
+		}
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	s.Register(srv)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := healthpb.HealthCheckResponse_SERVING, res.Status; want != have {
+		t.Fatalf("Check: want %v, have %v", want, have)
+	}
+
+	// Watchers are notified when the server drains
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := healthpb.HealthCheckResponse_SERVING, res.Status; want != have {
+		t.Fatalf("Watch: want %v, have %v", want, have)
+	}
+	s.Drain()
+	res, err = stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := healthpb.HealthCheckResponse_NOT_SERVING, res.Status; want != have {
+		t.Fatalf("Watch: want %v, have %v", want, have)
+	}
+}
+
+func TestGracefulStop(t *testing.T) {
+	s := NewServer(SetDrainWindow(200 * time.Millisecond))
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	s.Register(srv)
+	served := make(chan struct{})
+	go func() {
+		srv.Serve(lis)
+		close(served)
+	}()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop(srv)
+		close(stopped)
+	}()
+
+	// The server reports 503 while it drains, and keeps serving
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.Draining() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for server to drain")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if code, _ := get(t, s, ""); code != http.StatusServiceUnavailable {
+		t.Fatalf("Code: want %d, have %d", http.StatusServiceUnavailable, code)
+	}
+	select {
+	case <-served:
+		t.Fatal("want server to serve during the drain window")
+	default:
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for GracefulStop")
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for server to stop")
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package healthz
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// Status is the health status of an Endpoint.
+type Status int
+
+const (
+	// StatusUnknown is the status of an Endpoint that hasn't been checked yet.
+	StatusUnknown Status = iota
+	// StatusHealthy is the status of an Endpoint that passed its health check.
+	StatusHealthy
+	// StatusUnhealthy is the status of an Endpoint that failed its health check.
+	StatusUnhealthy
+)
+
+// String returns a textual representation of s.
+func (s Status) String() string {
+	switch s {
+	case StatusHealthy:
+		return "healthy"
+	case StatusUnhealthy:
+		return "unhealthy"
+	default:
+		return "unknown"
+	}
+}
+
+// Checker checks the health of an Endpoint. If Check returns an error,
+// the Resolver considers the Endpoint unhealthy, regardless of the
+// returned Status. Check must return when ctx is done.
+//
+// A Checker can be shared between endpoints, so Check must be safe for
+// concurrent use.
+type Checker interface {
+	Check(ctx context.Context, ep *Endpoint) (Status, error)
+}
+
+// checkerFor returns the Checker for ep. It falls back to a GRPCChecker
+// for endpoints with CheckGRPC, and to an HTTPChecker otherwise.
+func checkerFor(ep Endpoint) Checker {
+	switch {
+	case ep.Checker != nil:
+		return ep.Checker
+	case ep.CheckGRPC:
+		return &GRPCChecker{Service: ep.Service}
+	default:
+		return &HTTPChecker{}
+	}
+}
+
+// HTTPChecker checks an Endpoint with an HTTP request on its CheckURL.
+// By default, it sends a GET request and any 2xx status code is considered
+// healthy. Use the fields to e.g. pass an auth token, check the response
+// body or connect via mTLS.
+type HTTPChecker struct {
+	// Method is the HTTP method of the request. It defaults to GET.
+	Method string
+	// Header specifies the headers of the request. Use the "Host"
+	// header to override the host of the CheckURL.
+	Header http.Header
+
+	// ExpectedStatus is the list of status codes that are considered
+	// healthy. It defaults to any 2xx status code.
+	ExpectedStatus []int
+	// BodyContains, if not empty, must be contained in the response body.
+	BodyContains string
+	// JSONPath, if not empty, is a dot-separated path into the JSON
+	// response body, e.g. "status" or "checks.db.0.status". The value
+	// at the path must equal JSONValue, e.g. "ok". Array elements are
+	// addressed by their index.
+	JSONPath  string
+	JSONValue string
+
+	// Client is the HTTP client for the requests. If Client is nil,
+	// HTTPChecker uses a client created from TLSConfig and CheckRedirect,
+	// or http.DefaultClient if neither is set.
+	Client *http.Client
+	// TLSConfig specifies the TLS configuration for https URLs,
+	// e.g. the client certificates for mTLS.
+	TLSConfig *tls.Config
+	// CheckRedirect specifies the redirect policy as in http.Client,
+	// e.g. NoRedirect. It defaults to following up to 10 redirects.
+	CheckRedirect func(req *http.Request, via []*http.Request) error
+
+	once   sync.Once
+	client *http.Client
+}
+
+// NoRedirect is a redirect policy for HTTPChecker.CheckRedirect that
+// doesn't follow any redirects. The status code of the redirect
+// response is then checked against the expected status codes.
+func NoRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// maxBodySize is the maximum number of bytes HTTPChecker reads from
+// the response body.
+const maxBodySize = 1 << 20
+
+// Check implements the Checker interface.
+func (c *HTTPChecker) Check(ctx context.Context, ep *Endpoint) (Status, error) {
+	method := c.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequest(method, ep.CheckURL, nil)
+	if err != nil {
+		return StatusUnhealthy, err
+	}
+	for name, values := range c.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if host := c.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	res, err := ctxhttp.Do(ctx, c.httpClient(), req)
+	if err != nil {
+		return StatusUnhealthy, err
+	}
+	defer res.Body.Close()
+	if !c.expectedStatus(res.StatusCode) {
+		return StatusUnhealthy, nil
+	}
+	if c.BodyContains == "" && c.JSONPath == "" {
+		return StatusHealthy, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxBodySize))
+	if err != nil {
+		return StatusUnhealthy, err
+	}
+	if c.BodyContains != "" && !bytes.Contains(body, []byte(c.BodyContains)) {
+		return StatusUnhealthy, nil
+	}
+	if c.JSONPath != "" {
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return StatusUnhealthy, fmt.Errorf("decoding response of %s: %v", ep.CheckURL, err)
+		}
+		value, found := lookupJSONPath(doc, c.JSONPath)
+		if !found || fmt.Sprint(value) != c.JSONValue {
+			return StatusUnhealthy, nil
+		}
+	}
+	return StatusHealthy, nil
+}
+
+// httpClient returns the HTTP client to use for the requests.
+func (c *HTTPChecker) httpClient() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	c.once.Do(func() {
+		if c.TLSConfig == nil && c.CheckRedirect == nil {
+			c.client = http.DefaultClient
+			return
+		}
+		c.client = &http.Client{CheckRedirect: c.CheckRedirect}
+		if c.TLSConfig != nil {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = c.TLSConfig
+			c.client.Transport = transport
+		}
+	})
+	return c.client
+}
+
+// expectedStatus returns true if code is one of the expected status codes.
+func (c *HTTPChecker) expectedStatus(code int) bool {
+	if len(c.ExpectedStatus) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, expected := range c.ExpectedStatus {
+		if code == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupJSONPath returns the value at the dot-separated path in doc,
+// and false if there is no such value.
+func lookupJSONPath(doc interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			value, found := v[key]
+			if !found {
+				return nil, false
+			}
+			doc = value
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// TCPChecker checks an Endpoint by opening a TCP connection to its
+// address. The Endpoint is healthy if the connection can be established.
+// Use it for servers that don't expose any other health check.
+type TCPChecker struct {
+	// Addr is the address to connect to, e.g. 10.0.0.1:9000. It defaults
+	// to the Addr of the Endpoint.
+	Addr string
+}
+
+// Check implements the Checker interface.
+func (c *TCPChecker) Check(ctx context.Context, ep *Endpoint) (Status, error) {
+	addr := c.Addr
+	if addr == "" {
+		addr = ep.Addr
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return StatusUnhealthy, err
+	}
+	conn.Close()
+	return StatusHealthy, nil
+}
+
+// ExecChecker checks an Endpoint by running an external command.
+// The Endpoint is healthy if the command exits with status 0, like
+// the script checks of Consul or Nagios plugins.
+//
+// Occurrences of {addr} and {host} in Args are replaced by the address
+// and host of the Endpoint, e.g. Args: []string{"-H", "{host}"}.
+type ExecChecker struct {
+	Command string
+	Args    []string
+}
+
+// Check implements the Checker interface.
+func (c *ExecChecker) Check(ctx context.Context, ep *Endpoint) (Status, error) {
+	host, _, err := net.SplitHostPort(ep.Addr)
+	if err != nil {
+		host = ep.Addr
+	}
+	replacer := strings.NewReplacer("{addr}", ep.Addr, "{host}", host)
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = replacer.Replace(arg)
+	}
+	err = exec.CommandContext(ctx, c.Command, args...).Run()
+	if _, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+		// The command ran but failed
+		return StatusUnhealthy, nil
+	}
+	if err != nil {
+		return StatusUnhealthy, fmt.Errorf("running %s: %v", c.Command, err)
+	}
+	return StatusHealthy, nil
+}
@@ -0,0 +1,243 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package healthz
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/resolver"
+)
+
+// testChecker is a Checker that returns a fixed status.
+type testChecker struct {
+	mu     sync.Mutex
+	status Status
+}
+
+func (c *testChecker) Check(ctx context.Context, ep *Endpoint) (Status, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status, nil
+}
+
+func (c *testChecker) setStatus(status Status) {
+	c.mu.Lock()
+	c.status = status
+	c.mu.Unlock()
+}
+
+func TestHTTPChecker(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	c := &HTTPChecker{}
+	status, err := c.Check(context.Background(), &Endpoint{CheckURL: srv.URL + "/healthz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := StatusHealthy, status; want != have {
+		t.Errorf("Check: want %v, have %v", want, have)
+	}
+	status, err = c.Check(context.Background(), &Endpoint{CheckURL: srv.URL + "/other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := StatusUnhealthy, status; want != have {
+		t.Errorf("Check: want %v, have %v", want, have)
+	}
+}
+
+func TestHTTPCheckerOptions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/redirect":
+			http.Redirect(w, r, "/healthz", http.StatusFound)
+		case r.Header.Get("Authorization") != "Bearer secret":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status":"degraded","checks":{"db":[{"status":"ok"}]}}`))
+		}
+	}))
+	defer srv.Close()
+
+	auth := http.Header{"Authorization": []string{"Bearer secret"}}
+	tests := []struct {
+		Checker *HTTPChecker
+		Path    string
+		Status  Status
+	}{
+		{&HTTPChecker{}, "/healthz", StatusUnhealthy},
+		{&HTTPChecker{Header: auth}, "/healthz", StatusHealthy},
+		{&HTTPChecker{Header: auth, ExpectedStatus: []int{http.StatusNoContent}}, "/healthz", StatusUnhealthy},
+		{&HTTPChecker{Header: auth, Method: http.MethodHead, ExpectedStatus: []int{http.StatusNoContent}}, "/healthz", StatusHealthy},
+		{&HTTPChecker{ExpectedStatus: []int{http.StatusUnauthorized}}, "/healthz", StatusHealthy},
+		{&HTTPChecker{Header: auth, BodyContains: `"degraded"`}, "/healthz", StatusHealthy},
+		{&HTTPChecker{Header: auth, BodyContains: `"ok"}}`}, "/healthz", StatusUnhealthy},
+		{&HTTPChecker{Header: auth, JSONPath: "status", JSONValue: "ok"}, "/healthz", StatusUnhealthy},
+		{&HTTPChecker{Header: auth, JSONPath: "status", JSONValue: "degraded"}, "/healthz", StatusHealthy},
+		{&HTTPChecker{Header: auth, JSONPath: "checks.db.0.status", JSONValue: "ok"}, "/healthz", StatusHealthy},
+		{&HTTPChecker{Header: auth, JSONPath: "checks.db.1.status", JSONValue: "ok"}, "/healthz", StatusUnhealthy},
+		{&HTTPChecker{Header: auth}, "/redirect", StatusHealthy},
+		{&HTTPChecker{Header: auth, CheckRedirect: NoRedirect}, "/redirect", StatusUnhealthy},
+		{&HTTPChecker{CheckRedirect: NoRedirect, ExpectedStatus: []int{http.StatusFound}}, "/redirect", StatusHealthy},
+	}
+	for i, tt := range tests {
+		status, err := tt.Checker.Check(context.Background(), &Endpoint{CheckURL: srv.URL + tt.Path})
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if want, have := tt.Status, status; want != have {
+			t.Errorf("#%d: want %v, have %v", i, want, have)
+		}
+	}
+}
+
+func TestHTTPCheckerWithTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	// Without the certificate of srv, the check fails
+	status, err := (&HTTPChecker{}).Check(context.Background(), &Endpoint{CheckURL: srv.URL})
+	if err == nil {
+		t.Fatal("Check: want error, have nil")
+	}
+	if want, have := StatusUnhealthy, status; want != have {
+		t.Errorf("Check: want %v, have %v", want, have)
+	}
+
+	tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	status, err = (&HTTPChecker{TLSConfig: tlsConfig}).Check(context.Background(), &Endpoint{CheckURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := StatusHealthy, status; want != have {
+		t.Errorf("Check: want %v, have %v", want, have)
+	}
+
+	status, err = (&HTTPChecker{Client: srv.Client()}).Check(context.Background(), &Endpoint{CheckURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := StatusHealthy, status; want != have {
+		t.Errorf("Check: want %v, have %v", want, have)
+	}
+}
+
+func TestTCPChecker(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+
+	c := &TCPChecker{}
+	status, err := c.Check(context.Background(), &Endpoint{Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := StatusHealthy, status; want != have {
+		t.Errorf("Check: want %v, have %v", want, have)
+	}
+
+	// Nobody listens on addr anymore
+	lis.Close()
+	status, err = c.Check(context.Background(), &Endpoint{Addr: addr})
+	if err == nil {
+		t.Fatal("Check: want error, have nil")
+	}
+	if want, have := StatusUnhealthy, status; want != have {
+		t.Errorf("Check: want %v, have %v", want, have)
+	}
+}
+
+func TestExecChecker(t *testing.T) {
+	tests := []struct {
+		Checker *ExecChecker
+		Status  Status
+	}{
+		{
+			Checker: &ExecChecker{Command: "sh", Args: []string{"-c", "exit 0"}},
+			Status:  StatusHealthy,
+		},
+		{
+			Checker: &ExecChecker{Command: "sh", Args: []string{"-c", "exit 2"}},
+			Status:  StatusUnhealthy,
+		},
+		{
+			Checker: &ExecChecker{Command: "sh", Args: []string{"-c", `test "$0 $1" = "10.0.0.1:9000 10.0.0.1"`, "{addr}", "{host}"}},
+			Status:  StatusHealthy,
+		},
+	}
+	for i, tt := range tests {
+		status, err := tt.Checker.Check(context.Background(), &Endpoint{Addr: "10.0.0.1:9000"})
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if want, have := tt.Status, status; want != have {
+			t.Errorf("#%d: want %v, have %v", i, want, have)
+		}
+	}
+
+	// Commands that can't be run are an error
+	_, err := (&ExecChecker{Command: "/does/not/exist"}).Check(context.Background(), &Endpoint{})
+	if err == nil {
+		t.Fatal("Check: want error, have nil")
+	}
+}
+
+func TestResolverWithCheckers(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	c := &testChecker{status: StatusHealthy}
+	b := NewBuilder(
+		SetEndpoints(
+			Endpoint{Addr: lis.Addr().String(), Checker: &TCPChecker{}},
+			Endpoint{Addr: "10.0.0.1:9000", Checker: c},
+		),
+		SetUpdateInterval(100*time.Millisecond),
+		SetCheckTimeout(1*time.Second),
+	)
+	cc := newTestClientConn()
+	r, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	state := cc.waitForState(t)
+	if want, have := 2, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+
+	c.setStatus(StatusUnhealthy)
+	state = cc.waitForState(t)
+	if want, have := 1, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+	if want, have := lis.Addr().String(), state.Addresses[0].Addr; want != have {
+		t.Errorf("1st Addr: want %q, have %q", want, have)
+	}
+}
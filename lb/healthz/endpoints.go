@@ -0,0 +1,182 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package healthz
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// newEndpoint returns a copy of the settings of ep, without any state.
+func newEndpoint(ep Endpoint) *Endpoint {
+	return &Endpoint{
+		Addr:      ep.Addr,
+		CheckURL:  ep.CheckURL,
+		CheckGRPC: ep.CheckGRPC,
+		Service:   ep.Service,
+		Checker:   checkerFor(ep),
+		Weight:    ep.Weight,
+		Zone:      ep.Zone,
+		Interval:  ep.Interval,
+		Timeout:   ep.Timeout,
+		Rise:      ep.Rise,
+		Fall:      ep.Fall,
+		SlowStart: ep.SlowStart,
+	}
+}
+
+// openEndpoint prepares ep for health checks.
+func (r *Resolver) openEndpoint(ep *Endpoint) error {
+	ep.ctx, ep.cancel = context.WithCancel(r.ctx)
+	if err := r.dial(ep); err != nil {
+		ep.cancel()
+		return err
+	}
+	return nil
+}
+
+// closeEndpoint stops all health checks of ep and releases its resources.
+func (r *Resolver) closeEndpoint(ep *Endpoint) {
+	if ep.cancel != nil {
+		ep.cancel()
+	}
+	if ep.conn != nil {
+		ep.conn.Close()
+	}
+}
+
+// AddEndpoint adds an endpoint to the Resolver while it is running.
+// The endpoint is checked right away and pushed to the ClientConn as
+// soon as it is healthy. It returns ErrEndpointExists if the Resolver
+// already has an endpoint with the same address.
+func (r *Resolver) AddEndpoint(endpoint Endpoint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ctx.Err() != nil {
+		return ErrClosed
+	}
+	if r.indexOf(endpoint.Addr) >= 0 {
+		return ErrEndpointExists
+	}
+	ep := newEndpoint(endpoint)
+	if err := r.openEndpoint(ep); err != nil {
+		return err
+	}
+	r.endp = append(r.endp, ep)
+	r.startEndpoint(ep, 0, nil)
+	return nil
+}
+
+// RemoveEndpoint removes the endpoint with the given address from the
+// Resolver while it is running. If the endpoint is healthy, the ClientConn
+// is updated right away. It returns ErrEndpointNotFound if the Resolver
+// has no endpoint with the given address.
+func (r *Resolver) RemoveEndpoint(addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ctx.Err() != nil {
+		return ErrClosed
+	}
+	i := r.indexOf(addr)
+	if i < 0 {
+		return ErrEndpointNotFound
+	}
+	ep := r.endp[i]
+	r.endp = append(r.endp[:i:i], r.endp[i+1:]...)
+	r.closeEndpoint(ep)
+	if ep.healthy() {
+		r.spawn(r.updateState)
+	}
+	return nil
+}
+
+// ReplaceEndpoints replaces all endpoints of the Resolver while it is
+// running. Endpoints with an address that the Resolver already has keep
+// their health state, so they don't need to be checked again. New
+// endpoints are checked right away. It returns ErrEndpointExists if
+// endpoints contains the same address more than once.
+func (r *Resolver) ReplaceEndpoints(endpoints ...Endpoint) error {
+	if len(endpoints) == 0 {
+		return ErrNoEndpoints
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ctx.Err() != nil {
+		return ErrClosed
+	}
+	old := make(map[string]*Endpoint)
+	for _, ep := range r.endp {
+		old[ep.Addr] = ep
+	}
+	seen := make(map[string]bool)
+	endp := make([]*Endpoint, 0, len(endpoints))
+	var delays []time.Duration
+	var changed bool
+	for _, endpoint := range endpoints {
+		if seen[endpoint.Addr] {
+			r.closeEndpoints(endp)
+			return ErrEndpointExists
+		}
+		seen[endpoint.Addr] = true
+
+		ep := newEndpoint(endpoint)
+		if err := r.openEndpoint(ep); err != nil {
+			r.closeEndpoints(endp)
+			return err
+		}
+		delay := time.Duration(0)
+		if o, found := old[ep.Addr]; found {
+			if o.healthy() && (o.Weight != ep.Weight || o.Zone != ep.Zone) {
+				changed = true
+			}
+			ep.status = o.status
+			ep.successes = o.successes
+			ep.failures = o.failures
+			ep.lastChange = o.lastChange
+			ep.rampingUp = o.rampingUp
+			delay = r.randomDelay(ep)
+		}
+		endp = append(endp, ep)
+		delays = append(delays, delay)
+	}
+
+	for _, ep := range r.endp {
+		if !seen[ep.Addr] && ep.healthy() {
+			changed = true
+		}
+		r.closeEndpoint(ep)
+	}
+	r.endp = endp
+	for i, ep := range endp {
+		r.startEndpoint(ep, delays[i], nil)
+	}
+	if changed {
+		r.spawn(r.updateState)
+	}
+	return nil
+}
+
+// closeEndpoints calls closeEndpoint for all endpoints in endp.
+func (r *Resolver) closeEndpoints(endp []*Endpoint) {
+	for _, ep := range endp {
+		r.closeEndpoint(ep)
+	}
+}
+
+// indexOf returns the index of the endpoint with the given address,
+// or -1 if there is no such endpoint. The caller must hold r.mu.
+func (r *Resolver) indexOf(addr string) int {
+	for i, ep := range r.endp {
+		if ep.Addr == addr {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,167 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package healthz
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/olivere/grpc/lb/weighted"
+)
+
+// addrsOf returns the sorted addresses of state.
+func addrsOf(state resolver.State) []string {
+	var addrs []string
+	for _, addr := range state.Addresses {
+		addrs = append(addrs, addr.Addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func TestResolverAddAndRemoveEndpoints(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	healthy := &testChecker{status: StatusHealthy}
+	unhealthy := &testChecker{status: StatusUnhealthy}
+
+	// Periodic checks must not interfere with this test
+	b := NewBuilder(
+		SetEndpoints(Endpoint{Addr: "10.0.0.1:9000", Checker: healthy}),
+		SetUpdateInterval(1*time.Hour),
+		SetCheckTimeout(1*time.Second),
+	)
+	cc := newTestClientConn()
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	r := res.(*Resolver)
+
+	state := cc.waitForState(t)
+	if want, have := "[10.0.0.1:9000]", fmt.Sprint(addrsOf(state)); want != have {
+		t.Fatalf("addresses: want %s, have %s", want, have)
+	}
+
+	// Healthy endpoints are added right away
+	if err := r.AddEndpoint(Endpoint{Addr: "10.0.0.2:9000", Checker: healthy}); err != nil {
+		t.Fatal(err)
+	}
+	state = cc.waitForState(t)
+	if want, have := "[10.0.0.1:9000 10.0.0.2:9000]", fmt.Sprint(addrsOf(state)); want != have {
+		t.Fatalf("addresses: want %s, have %s", want, have)
+	}
+	if want, have := ErrEndpointExists, r.AddEndpoint(Endpoint{Addr: "10.0.0.2:9000"}); want != have {
+		t.Fatalf("AddEndpoint: want %v, have %v", want, have)
+	}
+
+	// Unhealthy endpoints are not added
+	if err := r.AddEndpoint(Endpoint{Addr: "10.0.0.3:9000", Checker: unhealthy}); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 3, len(r.Endpoints()); want != have {
+		t.Fatalf("Endpoints: want %d, have %d", want, have)
+	}
+
+	// Removing a healthy endpoint updates the ClientConn right away
+	if err := r.RemoveEndpoint("10.0.0.1:9000"); err != nil {
+		t.Fatal(err)
+	}
+	state = cc.waitForState(t)
+	if want, have := "[10.0.0.2:9000]", fmt.Sprint(addrsOf(state)); want != have {
+		t.Fatalf("addresses: want %s, have %s", want, have)
+	}
+	if want, have := ErrEndpointNotFound, r.RemoveEndpoint("10.0.0.1:9000"); want != have {
+		t.Fatalf("RemoveEndpoint: want %v, have %v", want, have)
+	}
+
+	// Removing an unhealthy endpoint doesn't change anything
+	if err := r.RemoveEndpoint("10.0.0.3:9000"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case state := <-cc.statec:
+		t.Fatalf("unexpected state: %+v", state)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	r.Close()
+	if want, have := ErrClosed, r.AddEndpoint(Endpoint{Addr: "10.0.0.4:9000"}); want != have {
+		t.Fatalf("AddEndpoint after Close: want %v, have %v", want, have)
+	}
+	if want, have := ErrClosed, r.RemoveEndpoint("10.0.0.2:9000"); want != have {
+		t.Fatalf("RemoveEndpoint after Close: want %v, have %v", want, have)
+	}
+}
+
+func TestResolverReplaceEndpoints(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	c1 := &testChecker{status: StatusHealthy}
+	c2 := &testChecker{status: StatusHealthy}
+	b := NewBuilder(
+		SetEndpoints(
+			Endpoint{Addr: "10.0.0.1:9000", Checker: c1},
+			Endpoint{Addr: "10.0.0.2:9000", Checker: c2},
+		),
+		SetUpdateInterval(1*time.Hour),
+		SetCheckTimeout(1*time.Second),
+	)
+	cc := newTestClientConn()
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	r := res.(*Resolver)
+
+	state := cc.waitForState(t)
+	if want, have := "[10.0.0.1:9000 10.0.0.2:9000]", fmt.Sprint(addrsOf(state)); want != have {
+		t.Fatalf("addresses: want %s, have %s", want, have)
+	}
+
+	// 10.0.0.2 keeps its state, even though its checker reports unhealthy now
+	c2.setStatus(StatusUnhealthy)
+	err = r.ReplaceEndpoints(
+		Endpoint{Addr: "10.0.0.2:9000", Checker: c2, Weight: 3},
+		Endpoint{Addr: "10.0.0.3:9000", Checker: c1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		state = cc.waitForState(t)
+		if fmt.Sprint(addrsOf(state)) == "[10.0.0.2:9000 10.0.0.3:9000]" {
+			break
+		}
+	}
+	for _, addr := range state.Addresses {
+		want := uint32(1)
+		if addr.Addr == "10.0.0.2:9000" {
+			want = 3
+		}
+		if have := weighted.Weight(addr); want != have {
+			t.Errorf("%s: want weight %d, have %d", addr.Addr, want, have)
+		}
+	}
+
+	err = r.ReplaceEndpoints(
+		Endpoint{Addr: "10.0.0.4:9000", Checker: c1},
+		Endpoint{Addr: "10.0.0.4:9000", Checker: c1},
+	)
+	if want, have := ErrEndpointExists, err; want != have {
+		t.Fatalf("ReplaceEndpoints: want %v, have %v", want, have)
+	}
+	if want, have := 2, len(r.Endpoints()); want != have {
+		t.Fatalf("Endpoints: want %d, have %d", want, have)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package healthz
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// errNoConn is returned by a GRPCChecker for endpoints without a connection.
+var errNoConn = errors.New("no connection to endpoint")
+
+// dial creates the connection for health checks of ep via the
+// gRPC Health Checking Protocol if ep has a GRPCChecker. The connection
+// is established lazily on the first health check.
+func (r *Resolver) dial(ep *Endpoint) error {
+	if _, ok := ep.Checker.(*GRPCChecker); !ok {
+		return nil
+	}
+	conn, err := grpc.NewClient("passthrough:///"+ep.Addr, r.dialOptions...)
+	if err != nil {
+		return err
+	}
+	ep.conn = conn
+	return nil
+}
+
+// startWatcher starts watching ep if it has a GRPCChecker, unless
+// disabled via SetWatch.
+func (r *Resolver) startWatcher(ep *Endpoint) {
+	if c, ok := ep.Checker.(*GRPCChecker); ok && r.watch {
+		r.spawn(func() { r.watcher(ep, c) })
+	}
+}
+
+// GRPCChecker checks an Endpoint via grpc.health.v1.Health/Check of the
+// gRPC Health Checking Protocol. The Endpoint is healthy if the service
+// is SERVING. The Resolver connects to the Addr of the Endpoint, see
+// SetDialOptions, and watches its status unless disabled via SetWatch.
+type GRPCChecker struct {
+	// Service is the name of the service to check. It defaults to the
+	// empty string, i.e. the health of the server as a whole.
+	Service string
+}
+
+// Check implements the Checker interface.
+func (c *GRPCChecker) Check(ctx context.Context, ep *Endpoint) (Status, error) {
+	if ep.conn == nil {
+		return StatusUnhealthy, errNoConn
+	}
+	res, err := healthpb.NewHealthClient(ep.conn).Check(ctx, &healthpb.HealthCheckRequest{
+		Service: c.Service,
+	})
+	if err != nil {
+		return StatusUnhealthy, err
+	}
+	return servingStatus(res.Status), nil
+}
+
+// servingStatus converts the status of the gRPC Health Checking Protocol
+// into the Status of an Endpoint.
+func servingStatus(s healthpb.HealthCheckResponse_ServingStatus) Status {
+	if s == healthpb.HealthCheckResponse_SERVING {
+		return StatusHealthy
+	}
+	return StatusUnhealthy
+}
+
+// watcher is a background process started for every endpoint with
+// a GRPCChecker, see startWatcher. It watches the status of the endpoint via
+// grpc.health.v1.Health/Watch and pushes changes to the ClientConn
+// immediately. If the stream breaks, watcher marks the endpoint as
+// unhealthy and retries after the check interval of the endpoint. If the server
+// doesn't implement Watch, the updater checks the endpoint periodically.
+func (r *Resolver) watcher(ep *Endpoint, c *GRPCChecker) {
+	for {
+		err := r.watchStream(ep, c)
+		if ep.ctx.Err() != nil {
+			// Resolver has been closed or ep has been removed
+			return
+		}
+		if status.Code(err) == codes.Unimplemented {
+			r.logger.Printf("grpc/lb/healthz: %s does not implement Watch, falling back to periodic checks", ep.Addr)
+			return
+		}
+		r.logger.Printf("grpc/lb/healthz: error watching %s: %v", ep.Addr, err)
+		r.setWatchStatus(ep, false, StatusUnhealthy)
+
+		select {
+		case <-ep.ctx.Done():
+			return
+		case <-time.After(r.intervalOf(ep)):
+		}
+	}
+}
+
+// watchStream runs a single Watch stream for ep until it breaks.
+func (r *Resolver) watchStream(ep *Endpoint, c *GRPCChecker) error {
+	stream, err := healthpb.NewHealthClient(ep.conn).Watch(ep.ctx, &healthpb.HealthCheckRequest{
+		Service: c.Service,
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		r.setWatchStatus(ep, true, servingStatus(res.Status))
+	}
+}
+
+// setWatchStatus sets the status of ep as reported by the Watch stream
+// and pushes the healthy endpoints to the ClientConn if it has changed.
+func (r *Resolver) setWatchStatus(ep *Endpoint, watching bool, status Status) {
+	r.mu.Lock()
+	if ep.ctx.Err() != nil {
+		// ep has been removed
+		r.mu.Unlock()
+		return
+	}
+	ep.watching = watching
+	var changed bool
+	if watching {
+		// The server reports status changes itself, so there is
+		// no need to apply the rise and fall thresholds
+		changed = r.transition(ep, status, time.Now())
+	} else {
+		changed = r.record(ep, status, time.Now())
+	}
+	// newResolver pushes the results of the initial checks
+	initialized := r.initialized
+	r.mu.Unlock()
+
+	if initialized && changed {
+		r.updateState()
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package healthz
+
+import (
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+// startHealthServer starts a gRPC server with the given health
+// service and returns its address and a func to stop it.
+func startHealthServer(t *testing.T, hs healthpb.HealthServer) (string, func()) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, hs)
+	go s.Serve(lis)
+	return lis.Addr().String(), s.Stop
+}
+
+// checkOnlyServer implements the Check method of the health service only.
+type checkOnlyServer struct {
+	healthpb.UnimplementedHealthServer
+
+	hs *health.Server
+}
+
+func (s checkOnlyServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	return s.hs.Check(ctx, req)
+}
+
+// flakyWatchServer implements the health service, but the first
+// Watch stream fails.
+type flakyWatchServer struct {
+	*health.Server
+
+	watches int32
+}
+
+func (s *flakyWatchServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	if atomic.AddInt32(&s.watches, 1) == 1 {
+		return status.Error(codes.Unavailable, "try again")
+	}
+	return s.Server.Watch(req, stream)
+}
+
+func TestResolverWithGRPCCheck(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	hs1 := health.NewServer()
+	hs1.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	addr1, stop1 := startHealthServer(t, hs1)
+	defer stop1()
+
+	hs2 := health.NewServer()
+	hs2.SetServingStatus("echo", healthpb.HealthCheckResponse_NOT_SERVING)
+	addr2, stop2 := startHealthServer(t, hs2)
+	defer stop2()
+
+	// Periodic checks only
+	u, err := url.Parse("healthz:///" + addr1 + "," + addr2 + "?check=grpc&service=echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder(SetWatch(false), SetUpdateInterval(100*time.Millisecond), SetCheckTimeout(1*time.Second))
+	cc := newTestClientConn()
+	r, err := b.Build(resolver.Target{URL: *u}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	state := cc.waitForState(t)
+	if want, have := 1, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+	if want, have := addr1, state.Addresses[0].Addr; want != have {
+		t.Errorf("1st Addr: want %q, have %q", want, have)
+	}
+
+	// Switch the statuses
+	hs1.SetServingStatus("echo", healthpb.HealthCheckResponse_NOT_SERVING)
+	hs2.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	for {
+		state = cc.waitForState(t)
+		if len(state.Addresses) == 1 && state.Addresses[0].Addr == addr2 {
+			break
+		}
+	}
+}
+
+func TestResolverWithGRPCWatch(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	hs := health.NewServer()
+	addr, stop := startHealthServer(t, hs)
+	defer stop()
+
+	// Watch must report changes long before the next periodic check
+	b := NewBuilder(
+		SetEndpoints(Endpoint{Addr: addr, CheckGRPC: true}),
+		SetUpdateInterval(1*time.Hour),
+		SetCheckTimeout(1*time.Second),
+	)
+	cc := newTestClientConn()
+	r, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	state := cc.waitForState(t)
+	if want, have := 1, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	state = cc.waitForState(t)
+	if want, have := 0, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	state = cc.waitForState(t)
+	if want, have := 1, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+}
+
+func TestResolverWithGRPCWatchRetry(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	hs := &flakyWatchServer{Server: health.NewServer()}
+	addr, stop := startHealthServer(t, hs)
+	defer stop()
+
+	// The watch is retried after the interval of the endpoint, not after
+	// the update interval of the Resolver
+	b := NewBuilder(
+		SetEndpoints(Endpoint{Addr: addr, CheckGRPC: true, Interval: 50 * time.Millisecond}),
+		SetUpdateInterval(1*time.Hour),
+		SetCheckTimeout(1*time.Second),
+	)
+	cc := newTestClientConn()
+	r, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&hs.watches) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the watch to be retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResolverWithGRPCWatchUnimplemented(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	hs := health.NewServer()
+	addr, stop := startHealthServer(t, checkOnlyServer{hs: hs})
+	defer stop()
+
+	b := NewBuilder(
+		SetEndpoints(Endpoint{Addr: addr, CheckGRPC: true}),
+		SetUpdateInterval(100*time.Millisecond),
+		SetCheckTimeout(1*time.Second),
+	)
+	cc := newTestClientConn()
+	r, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	state := cc.waitForState(t)
+	if want, have := 1, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+
+	// Periodic checks must take over
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	state = cc.waitForState(t)
+	if want, have := 0, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+}
@@ -6,24 +6,48 @@ package healthz
 
 import (
 	"errors"
-	"net/http"
+	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/net/context"
-	"golang.org/x/net/context/ctxhttp"
-	"golang.org/x/sync/errgroup"
-	"google.golang.org/grpc/naming"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/olivere/grpc/lb/locality"
+	"github.com/olivere/grpc/lb/weighted"
 )
 
+// Scheme is the scheme the Builder is registered with in gRPC.
+// Use e.g. "healthz:///127.0.0.1:10000,127.0.0.1:10001" as a target
+// to resolve to the healthy endpoints of the given list.
+const Scheme = "healthz"
+
 var (
-	defaultCheckTimeout   = 5 * time.Second
-	defaultUpdateInterval = 30 * time.Second
+	defaultCheckTimeout        = 5 * time.Second
+	defaultUpdateInterval      = 30 * time.Second
+	defaultJitter              = 0.1
+	defaultMaxConcurrentChecks = 64
+	defaultCheckURL            = "http://{addr}/healthz"
 
 	// ErrNoEndpoints is returned when you passed no endpoints to the Resolver.
 	ErrNoEndpoints = errors.New("no endpoints specified")
+	// ErrEndpointExists is returned when adding an endpoint with an
+	// address that the Resolver already has.
+	ErrEndpointExists = errors.New("endpoint already exists")
+	// ErrEndpointNotFound is returned when removing an endpoint with an
+	// address that the Resolver doesn't have.
+	ErrEndpointNotFound = errors.New("endpoint not found")
+	// ErrClosed is returned when changing the endpoints of a closed Resolver.
+	ErrClosed = errors.New("resolver is closed")
 )
 
+func init() {
+	resolver.Register(NewBuilder())
+}
+
 // Logger allows to pass an optional logger to the resolver.
 type Logger interface {
 	Printf(format string, values ...interface{})
@@ -35,37 +59,162 @@ type nopLogger struct{}
 // Printf does not log anything.
 func (nopLogger) Printf(format string, v ...interface{}) {}
 
+// Builder implements the gRPC resolver.Builder interface. It creates
+// a Resolver for targets of the form healthz:///host1:port1,host2:port2.
+//
+// The check URL of each endpoint defaults to http://{addr}/healthz, where
+// {addr} is replaced by the address of the endpoint and {host} by its host.
+// Use the "check" query parameter to change it, e.g.
+// healthz:///10.0.0.1:9000,10.0.0.2:9000?check=http://{host}:8080/status.
+//
+// Use "check=grpc" to check the endpoints with the gRPC Health Checking
+// Protocol instead, and the "service" query parameter to pass the name
+// of the service to check, e.g.
+// healthz:///10.0.0.1:9000,10.0.0.2:9000?check=grpc&service=echo.
+// Use "check=tcp" to check whether the endpoints accept TCP connections.
+//
+// The Builder without options is registered with gRPC automatically.
+// Use NewBuilder together with grpc.WithResolvers to pass options, e.g.
+// a fixed list of endpoints to use for targets without endpoints.
+type Builder struct {
+	options []ResolverOption
+}
+
+// NewBuilder initializes and returns a new Builder. The options are
+// applied to every Resolver created by the Builder.
+func NewBuilder(options ...ResolverOption) *Builder {
+	return &Builder{options: options}
+}
+
+// Scheme returns the scheme supported by the Builder.
+func (b *Builder) Scheme() string {
+	return Scheme
+}
+
+// Build creates a new Resolver for the given target.
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	options := append([]ResolverOption{}, b.options...)
+	if endpoints := parseTarget(target); len(endpoints) > 0 {
+		options = append(options, SetEndpoints(endpoints...))
+	}
+	return newResolver(cc, options...)
+}
+
+// parseTarget returns the list of endpoints specified in target.
+func parseTarget(target resolver.Target) []Endpoint {
+	query := target.URL.Query()
+	checkURL := query.Get("check")
+	if checkURL == "" {
+		checkURL = defaultCheckURL
+	}
+	var endpoints []Endpoint
+	for _, addr := range strings.Split(target.Endpoint(), ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		switch checkURL {
+		case "grpc":
+			endpoints = append(endpoints, Endpoint{
+				Addr:      addr,
+				CheckGRPC: true,
+				Service:   query.Get("service"),
+			})
+		case "tcp":
+			endpoints = append(endpoints, Endpoint{
+				Addr:    addr,
+				Checker: &TCPChecker{},
+			})
+		default:
+			endpoints = append(endpoints, Endpoint{
+				Addr:     addr,
+				CheckURL: strings.NewReplacer("{addr}", addr, "{host}", host).Replace(checkURL),
+			})
+		}
+	}
+	return endpoints
+}
+
 // Resolver implements the gRPC Resolver interface using a simple
 // health endpoint check on a list of clients initially passed to the
-// resolver.
+// resolver. It pushes the list of healthy endpoints to the gRPC ClientConn
+// whenever an endpoint changes its health status.
 //
 // See the gRPC load balancing documentation for details about Balancer and
 // Resolver: https://github.com/grpc/grpc/blob/master/doc/load-balancing.md.
 type Resolver struct {
+	cc resolver.ClientConn
+
 	mu   sync.Mutex
 	endp []*Endpoint
 
+	stateMu sync.Mutex // serializes updates of the ClientConn
+
 	logger         Logger
 	checkTimeout   time.Duration
 	updateInterval time.Duration
-
-	quitc    chan struct{}
-	updatesc chan []*naming.Update
+	jitter         float64
+	maxChecks      int
+	sem            chan struct{} // limits the number of concurrent checks
+	initialized    bool          // true after the initial checks in newResolver
+	watch          bool
+	dialOptions    []grpc.DialOption
+	rise           int
+	fall           int
+	slowStart      time.Duration
+	panicThreshold float64
+	panicking      bool // true while in panic mode, see SetPanicThreshold
+
+	closeMu sync.Mutex // guards cancel and starting background processes
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
 }
 
-// Endpoint is an endpoint that serves gRPC and responds to health
-// checks on the CheckURL.
+// Endpoint is an endpoint that serves gRPC and is checked by its Checker.
+//
+// If Checker is nil, the endpoint is checked via the gRPC Health Checking
+// Protocol if CheckGRPC is set, and with a GET request on CheckURL otherwise.
 type Endpoint struct {
-	Addr     string // e.g. 127.0.0.1:10000
-	CheckURL string // e.g. http://127.0.0.1:10000/healthz
+	Addr      string  // e.g. 127.0.0.1:10000
+	CheckURL  string  // e.g. http://127.0.0.1:10000/healthz
+	CheckGRPC bool    // use grpc.health.v1.Health on Addr instead of CheckURL
+	Service   string  // service name for CheckGRPC, empty for the server as a whole
+	Checker   Checker // optional, e.g. &TCPChecker{}
+	Weight    uint32  // optional weight, see package weighted
+	Zone      string  // optional zone, see package locality
+
+	Interval  time.Duration // optional, see SetUpdateInterval
+	Timeout   time.Duration // optional, see SetCheckTimeout
+	Rise      int           // optional, see SetRise
+	Fall      int           // optional, see SetFall
+	SlowStart time.Duration // optional, see SetSlowStart
+
+	status     Status           // current status, see record
+	successes  int              // number of consecutive successful checks
+	failures   int              // number of consecutive failed checks
+	lastChange time.Time        // time of the last status change
+	rampingUp  bool             // true while the weight of ep ramps up, see SetSlowStart
+	conn       *grpc.ClientConn // connection for a GRPCChecker
+	watching   bool             // true while a Watch stream reports the status
+
+	ctx    context.Context // cancelled when ep is removed or the Resolver is closed
+	cancel context.CancelFunc
+}
 
-	status int // last HTTP status for CheckURL
+// healthy returns true if the endpoint is considered healthy.
+func (ep *Endpoint) healthy() bool {
+	return ep.status == StatusHealthy
 }
 
 // ResolverOption is a callback for setting the options of the Resolver.
 type ResolverOption func(*Resolver) error
 
-// NewResolver initializes and returns a new Resolver.
+// newResolver initializes and returns a new Resolver.
 //
 // It resolves addresses for gRPC connections to the given list of host:port
 // endpoints. It runs HTTP-based health checks periodically to ensure that
@@ -73,12 +222,20 @@ type ResolverOption func(*Resolver) error
 // respond in time, it is removed from the list of valid endpoints. Once it
 // comes up again, it will be added to the list of healthy endpoints again,
 // and traffic will be served to that endpoint again.
-func NewResolver(options ...ResolverOption) (*Resolver, error) {
+func newResolver(cc resolver.ClientConn, options ...ResolverOption) (*Resolver, error) {
 	r := &Resolver{
+		cc:             cc,
 		logger:         nopLogger{},
 		checkTimeout:   defaultCheckTimeout,
 		updateInterval: defaultUpdateInterval,
-		quitc:          make(chan struct{}),
+		jitter:         defaultJitter,
+		maxChecks:      defaultMaxConcurrentChecks,
+		watch:          true,
+		rise:           1,
+		fall:           1,
+		dialOptions: []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		},
 	}
 	for _, option := range options {
 		if err := option(r); err != nil {
@@ -88,17 +245,42 @@ func NewResolver(options ...ResolverOption) (*Resolver, error) {
 	if len(r.endp) == 0 {
 		return nil, ErrNoEndpoints
 	}
-	r.updatesc = make(chan []*naming.Update, len(r.endp))
+	if r.maxChecks > 0 {
+		r.sem = make(chan struct{}, r.maxChecks)
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	for _, ep := range r.endp {
+		if err := r.openEndpoint(ep); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
 
-	// Run an initial update to ensure the endpoints are valid on the first call.
+	// Start the schedules of all endpoints and wait for their first check
+	// to ensure the endpoints are valid on the first call. Slow endpoints
+	// are pushed to the ClientConn later, once they are healthy.
 	// Don't worry if there are no healthy endpoints, just continue to watch.
-	updates, err := r.update()
-	if err == nil && len(updates) > 0 {
-		r.updatesc <- updates
+	checked := make(chan struct{}, len(r.endp))
+	for _, ep := range r.endp {
+		r.startEndpoint(ep, 0, checked)
+	}
+	timeout := time.NewTimer(r.checkTimeout)
+	defer timeout.Stop()
+	for range r.endp {
+		select {
+		case <-checked:
+			continue
+		case <-timeout.C:
+		}
+		break
+	}
+	r.mu.Lock()
+	r.initialized = true
+	changed := r.anyHealthy() || r.panicThreshold > 0
+	r.mu.Unlock()
+	if changed {
+		r.updateState()
 	}
-
-	// Start updater
-	go r.updater()
 
 	return r, nil
 }
@@ -108,11 +290,7 @@ func SetEndpoints(endpoints ...Endpoint) ResolverOption {
 	return func(r *Resolver) error {
 		endp := make([]*Endpoint, len(endpoints))
 		for i, ep := range endpoints {
-			endp[i] = &Endpoint{
-				Addr:     ep.Addr,
-				CheckURL: ep.CheckURL,
-				status:   http.StatusServiceUnavailable,
-			}
+			endp[i] = newEndpoint(ep)
 		}
 		r.endp = endp
 		return nil
@@ -128,7 +306,8 @@ func SetLogger(logger Logger) ResolverOption {
 }
 
 // SetCheckTimeout specifies the duration after which an endpoint
-// is considered gone in a health check.
+// is considered gone in a health check. Use the Timeout field of an
+// Endpoint to override it per endpoint.
 func SetCheckTimeout(timeout time.Duration) ResolverOption {
 	return func(r *Resolver) error {
 		r.checkTimeout = timeout
@@ -137,6 +316,8 @@ func SetCheckTimeout(timeout time.Duration) ResolverOption {
 }
 
 // SetUpdateInterval specifies the interval in which to run health checks.
+// Every endpoint is checked on its own schedule, see SetJitter. Use the
+// Interval field of an Endpoint to override it per endpoint.
 func SetUpdateInterval(interval time.Duration) ResolverOption {
 	return func(r *Resolver) error {
 		r.updateInterval = interval
@@ -144,99 +325,108 @@ func SetUpdateInterval(interval time.Duration) ResolverOption {
 	}
 }
 
-// Resolve creates a watcher for target. The watcher interface is implemented
-// by Resolver as well, see Next and Close.
-func (r *Resolver) Resolve(target string) (naming.Watcher, error) {
-	return r, nil
+// SetWatch specifies whether to use the Watch stream of the gRPC Health
+// Checking Protocol for endpoints with a GRPCChecker. Watching reports status
+// changes immediately instead of on the next health check. If a server
+// doesn't implement Watch, the Resolver falls back to periodic checks.
+// Watching is enabled by default.
+func SetWatch(enabled bool) ResolverOption {
+	return func(r *Resolver) error {
+		r.watch = enabled
+		return nil
+	}
 }
 
-// Next blocks until an update or error happens. It may return one or more
-// updates. The first call will return the full set of instances available
-// as NewResolver will look those up. Subsequent calls to Next() will
-// block until the resolver finds any new or removed instance.
-//
-// An error is returned if and only if the watcher cannot recover.
-func (r *Resolver) Next() ([]*naming.Update, error) {
-	return <-r.updatesc, nil
+// SetDialOptions specifies the options for connecting to endpoints with
+// a GRPCChecker. It defaults to a connection with insecure credentials.
+func SetDialOptions(opts ...grpc.DialOption) ResolverOption {
+	return func(r *Resolver) error {
+		r.dialOptions = opts
+		return nil
+	}
 }
 
-// Close closes the watcher.
-func (r *Resolver) Close() {
-	select {
-	case <-r.quitc:
-	default:
-		close(r.quitc)
-		close(r.updatesc)
+// Endpoints returns a snapshot of the endpoints of the Resolver,
+// including their current health state.
+func (r *Resolver) Endpoints() []Endpoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	endpoints := make([]Endpoint, len(r.endp))
+	for i, ep := range r.endp {
+		endpoints[i] = *ep
 	}
+	return endpoints
 }
 
-// updater is a background process started in NewResolver.
-func (r *Resolver) updater() {
-	t := time.NewTicker(r.updateInterval)
-	defer t.Stop()
+// ResolveNow is a no-op for a Resolver. It checks the endpoints
+// periodically, see SetUpdateInterval.
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {}
 
-	for {
-		select {
-		case <-r.quitc:
-			break
-		case <-t.C:
-			updates, err := r.update()
-			if err != nil {
-				r.logger.Printf("grpc/lb/healthz: error retrieving updates: %v", err)
-				continue
-			}
-			r.updatesc <- updates
-		}
-	}
-}
+// Close closes the resolver. It cancels all running health checks and
+// waits for the background processes to finish, so the ClientConn receives
+// no more updates after Close returns. It is safe to call Close more
+// than once.
+func (r *Resolver) Close() {
+	r.closeMu.Lock()
+	r.cancel()
+	r.closeMu.Unlock()
+	r.wg.Wait()
 
-// update checks the endpoints, sets their alive flag and returns a list
-// of updates in an array of naming.Updates.
-func (r *Resolver) update() ([]*naming.Update, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.closeEndpoints(r.endp)
+}
+
+// spawn runs f in a background process that Close waits for. It doesn't
+// run f if the Resolver has been closed already.
+func (r *Resolver) spawn(f func()) {
+	r.closeMu.Lock()
+	defer r.closeMu.Unlock()
+	if r.ctx.Err() != nil {
+		return
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		f()
+	}()
+}
 
-	oldStatuses := make(map[*Endpoint]int)
+// anyHealthy returns true if any endpoint is healthy.
+// The caller must hold r.mu.
+func (r *Resolver) anyHealthy() bool {
 	for _, ep := range r.endp {
-		oldStatuses[ep] = ep.status
+		if ep.healthy() {
+			return true
+		}
 	}
+	return false
+}
 
-	// Run all checks in parallel
-	ctx, cancel := context.WithTimeout(context.Background(), r.checkTimeout)
-	defer cancel()
-	g, ctx := errgroup.WithContext(ctx)
+// updateState pushes the list of healthy endpoints to the ClientConn,
+// or all endpoints in panic mode.
+func (r *Resolver) updateState() {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
 
+	r.mu.Lock()
+	now := time.Now()
+	scale := r.usesSlowStart()
+	panicking := r.updatePanicMode()
+	var addrs []resolver.Address
 	for _, ep := range r.endp {
-		ep := ep // https://golang.org/doc/faq#closures_and_goroutines
-		g.Go(func() error {
-			res, err := ctxhttp.Get(ctx, http.DefaultClient, ep.CheckURL)
-			if err != nil {
-				// Mark endpoint as unhealthy
-				ep.status = http.StatusServiceUnavailable
-				return nil
+		if ep.healthy() || panicking {
+			addr := resolver.Address{Addr: ep.Addr}
+			if weight := r.weight(ep, scale, now); weight > 0 {
+				addr = weighted.SetWeight(addr, weight)
+			}
+			if ep.Zone != "" {
+				addr = locality.SetZone(addr, ep.Zone)
 			}
-			defer res.Body.Close()
-			ep.status = res.StatusCode
-			return nil
-		})
-	}
-	if err := g.Wait(); err != nil {
-		return nil, err
-	}
-
-	var updates []*naming.Update
-	for ep, oldStatus := range oldStatuses {
-		// fmt.Printf("%v changed from %d to %d\n", ep.Addr, oldStatus, ep.status)
-		oldOK := oldStatus >= 200 && oldStatus < 300
-		newOK := ep.status >= 200 && ep.status < 300
-		if oldOK && !newOK {
-			// Was OK, is no longer OK => Delete
-			updates = append(updates, &naming.Update{Op: naming.Delete, Addr: ep.Addr})
-		} else if !oldOK && newOK {
-			// Has failed, is OK now => Add
-			updates = append(updates, &naming.Update{Op: naming.Add, Addr: ep.Addr})
+			addrs = append(addrs, addr)
 		}
 	}
+	r.mu.Unlock()
 
-	return updates, nil
+	r.cc.UpdateState(resolver.State{Addresses: addrs})
 }
@@ -7,15 +7,55 @@ package healthz
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"google.golang.org/grpc/naming"
-	// "google.golang.org/grpc/naming"
-	"sync"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc/resolver"
 )
 
+// testClientConn implements resolver.ClientConn and records the
+// states pushed by the Resolver.
+type testClientConn struct {
+	resolver.ClientConn // unimplemented methods panic
+
+	statec chan resolver.State
+}
+
+func newTestClientConn() *testClientConn {
+	return &testClientConn{statec: make(chan resolver.State, 10)}
+}
+
+func (cc *testClientConn) UpdateState(state resolver.State) error {
+	select {
+	case cc.statec <- state:
+	default:
+		// Drop the state if the test doesn't consume it
+	}
+	return nil
+}
+
+func (cc *testClientConn) ReportError(err error) {}
+
+// waitForState waits for the next state pushed to cc.
+func (cc *testClientConn) waitForState(t *testing.T) resolver.State {
+	t.Helper()
+	select {
+	case state := <-cc.statec:
+		return state
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for resolver state")
+	}
+	return resolver.State{}
+}
+
 func TestResolver(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
 	var endpoints []Endpoint
 
 	var srv1mu sync.Mutex
@@ -45,69 +85,158 @@ func TestResolver(t *testing.T) {
 	})
 
 	// Setup Resolver
-	r, err := NewResolver(SetEndpoints(endpoints...), SetUpdateInterval(3*time.Second), SetCheckTimeout(1*time.Second))
-	if err != nil {
-		t.Fatal(err)
-	}
-	w, err := r.Resolve("")
+	b := NewBuilder(SetEndpoints(endpoints...), SetUpdateInterval(3*time.Second), SetCheckTimeout(1*time.Second))
+	cc := newTestClientConn()
+	r, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer w.Close()
+	defer r.Close()
 
-	updates, err := w.Next()
-	if err != nil {
-		t.Fatal(err)
-	}
-	if want, have := 2, len(updates); want != have {
-		t.Fatalf("retrieve updates via Next(): want %d, have %d", want, have)
-	}
-	if updates[0].Addr != "127.0.0.1:10000" && updates[0].Addr != "127.0.0.1:10001" {
-		t.Errorf("1st update Addr: have %q", updates[0].Addr)
+	state := cc.waitForState(t)
+	if want, have := 2, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
 	}
-	if want, have := naming.Add, updates[0].Op; want != have {
-		t.Errorf("1st update Op: want %v, have %v", want, have)
+	if state.Addresses[0].Addr != "127.0.0.1:10000" && state.Addresses[0].Addr != "127.0.0.1:10001" {
+		t.Errorf("1st Addr: have %q", state.Addresses[0].Addr)
 	}
-	if updates[1].Addr != "127.0.0.1:10000" && updates[1].Addr != "127.0.0.1:10001" {
-		t.Errorf("2nd update Addr: have %q", updates[1].Addr)
-	}
-	if want, have := naming.Add, updates[1].Op; want != have {
-		t.Errorf("2nd update Op: want %v, have %v", want, have)
+	if state.Addresses[1].Addr != "127.0.0.1:10000" && state.Addresses[1].Addr != "127.0.0.1:10001" {
+		t.Errorf("2nd Addr: have %q", state.Addresses[1].Addr)
 	}
 
-	// Disable srv1, and we should receive a Delete op
+	// Disable srv1, and we should only receive srv2
 	srv1mu.Lock()
 	srv1status = http.StatusBadGateway
 	srv1mu.Unlock()
-	updates, err = w.Next()
-	if err != nil {
-		t.Fatal(err)
-	}
-	if want, have := 1, len(updates); want != have {
-		t.Fatalf("retrieve updates via Next(): want %d, have %d", want, have)
-	}
-	if updates[0].Addr != "127.0.0.1:10000" {
-		t.Errorf("1st update Addr: have %q", updates[0].Addr)
+	state = cc.waitForState(t)
+	if want, have := 1, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
 	}
-	if want, have := naming.Delete, updates[0].Op; want != have {
-		t.Errorf("1st update Op: want %v, have %v", want, have)
+	if want, have := "127.0.0.1:10001", state.Addresses[0].Addr; want != have {
+		t.Errorf("1st Addr: want %q, have %q", want, have)
 	}
 
-	// Enable srv1 again, and we should receive an Add op
+	// Enable srv1 again, and we should receive both again
 	srv1mu.Lock()
 	srv1status = http.StatusOK
 	srv1mu.Unlock()
-	updates, err = w.Next()
+	state = cc.waitForState(t)
+	if want, have := 2, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+}
+
+func TestResolverClose(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// srv answers the initial health check and blocks all later
+	// health checks until the test finishes
+	donec := make(chan struct{})
+	var checks int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&checks, 1) == 1 {
+			return
+		}
+		select {
+		case <-donec:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(donec)
+
+	b := NewBuilder(
+		SetEndpoints(Endpoint{Addr: "127.0.0.1:10000", CheckURL: srv.URL}),
+		SetUpdateInterval(10*time.Millisecond),
+		SetCheckTimeout(1*time.Minute),
+	)
+	cc := newTestClientConn()
+	r, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want, have := 1, len(updates); want != have {
-		t.Fatalf("retrieve updates via Next(): want %d, have %d", want, have)
+
+	cc.waitForState(t)
+
+	// Give the updater a chance to run into the blocking health check
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		r.Close() // must be safe to call twice
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not cancel the running health check")
+	}
+
+	// No more updates after Close
+	select {
+	case state := <-cc.statec:
+		t.Fatalf("unexpected state after Close: %+v", state)
+	default:
 	}
-	if updates[0].Addr != "127.0.0.1:10000" {
-		t.Errorf("1st update Addr: have %q", updates[0].Addr)
+}
+
+func TestBuilderWithoutEndpoints(t *testing.T) {
+	_, err := NewBuilder().Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, newTestClientConn(), resolver.BuildOptions{})
+	if want, have := ErrNoEndpoints, err; want != have {
+		t.Fatalf("Build: want %v, have %v", want, have)
 	}
-	if want, have := naming.Add, updates[0].Op; want != have {
-		t.Errorf("1st update Op: want %v, have %v", want, have)
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		Target    string
+		Endpoints []Endpoint
+	}{
+		{
+			Target:    "healthz:///",
+			Endpoints: nil,
+		},
+		{
+			Target: "healthz:///127.0.0.1:10000,127.0.0.1:10001",
+			Endpoints: []Endpoint{
+				{Addr: "127.0.0.1:10000", CheckURL: "http://127.0.0.1:10000/healthz"},
+				{Addr: "127.0.0.1:10001", CheckURL: "http://127.0.0.1:10001/healthz"},
+			},
+		},
+		{
+			Target: "healthz:///10.0.0.1:9000?check=https://{host}:8080/status",
+			Endpoints: []Endpoint{
+				{Addr: "10.0.0.1:9000", CheckURL: "https://10.0.0.1:8080/status"},
+			},
+		},
+		{
+			Target: "healthz:///10.0.0.1:9000,10.0.0.2:9000?check=grpc&service=echo",
+			Endpoints: []Endpoint{
+				{Addr: "10.0.0.1:9000", CheckGRPC: true, Service: "echo"},
+				{Addr: "10.0.0.2:9000", CheckGRPC: true, Service: "echo"},
+			},
+		},
+		{
+			Target: "healthz:///10.0.0.1:9000?check=tcp",
+			Endpoints: []Endpoint{
+				{Addr: "10.0.0.1:9000", Checker: &TCPChecker{}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.Target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoints := parseTarget(resolver.Target{URL: *u})
+		if want, have := len(tt.Endpoints), len(endpoints); want != have {
+			t.Fatalf("%s: want %d endpoints, have %d", tt.Target, want, have)
+		}
+		for i := range endpoints {
+			if want, have := tt.Endpoints[i], endpoints[i]; !reflect.DeepEqual(want, have) {
+				t.Errorf("%s: endpoint %d: want %+v, have %+v", tt.Target, i, want, have)
+			}
+		}
 	}
 }
@@ -0,0 +1,52 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package healthz
+
+// SetPanicThreshold enables the panic mode of the Resolver, like the
+// panic routing of Envoy. If the percentage of healthy endpoints drops
+// below the given threshold, e.g. 50 for 50%, the Resolver pushes all
+// endpoints to the ClientConn, including the unhealthy ones. This keeps
+// the clients working if the health checks fail for reasons that don't
+// affect gRPC, e.g. if the network of the checks is partitioned.
+//
+// The Resolver logs when it enters and leaves the panic mode, see
+// SetLogger and Panicking. The panic mode is disabled by default.
+func SetPanicThreshold(percent float64) ResolverOption {
+	return func(r *Resolver) error {
+		r.panicThreshold = percent
+		return nil
+	}
+}
+
+// Panicking returns true if the Resolver is in panic mode,
+// see SetPanicThreshold.
+func (r *Resolver) Panicking() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.panicking
+}
+
+// updatePanicMode decides whether the Resolver is in panic mode and
+// logs when that changes. The caller must hold r.mu.
+func (r *Resolver) updatePanicMode() bool {
+	if r.panicThreshold <= 0 || len(r.endp) == 0 {
+		r.panicking = false
+		return false
+	}
+	var healthy int
+	for _, ep := range r.endp {
+		if ep.healthy() {
+			healthy++
+		}
+	}
+	panicking := float64(healthy)*100 < r.panicThreshold*float64(len(r.endp))
+	if panicking && !r.panicking {
+		r.logger.Printf("grpc/lb/healthz: entering panic mode with %d of %d endpoints healthy, using all endpoints", healthy, len(r.endp))
+	} else if !panicking && r.panicking {
+		r.logger.Printf("grpc/lb/healthz: leaving panic mode with %d of %d endpoints healthy", healthy, len(r.endp))
+	}
+	r.panicking = panicking
+	return panicking
+}
@@ -0,0 +1,153 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package healthz
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestResolverWithPanicThreshold(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	c1 := &testChecker{status: StatusHealthy}
+	c2 := &testChecker{status: StatusHealthy}
+	b := NewBuilder(
+		SetEndpoints(
+			Endpoint{Addr: "10.0.0.1:9000", Checker: c1},
+			Endpoint{Addr: "10.0.0.2:9000", Checker: c2},
+			Endpoint{Addr: "10.0.0.3:9000", Checker: &testChecker{status: StatusHealthy}},
+			Endpoint{Addr: "10.0.0.4:9000", Checker: &testChecker{status: StatusHealthy}},
+		),
+		SetPanicThreshold(60),
+		SetUpdateInterval(20*time.Millisecond),
+	)
+	cc := newTestClientConn()
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	r := res.(*Resolver)
+
+	state := cc.waitForState(t)
+	if want, have := 4, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+
+	// 75% healthy is still fine
+	c1.setStatus(StatusUnhealthy)
+	for {
+		state = cc.waitForState(t)
+		if len(state.Addresses) == 3 {
+			break
+		}
+	}
+	if r.Panicking() {
+		t.Fatal("want Resolver not in panic mode")
+	}
+	c2.setStatus(StatusUnhealthy)
+	for {
+		state = cc.waitForState(t)
+		if len(state.Addresses) == 4 {
+			break
+		}
+	}
+	if want, have := "[10.0.0.1:9000 10.0.0.2:9000 10.0.0.3:9000 10.0.0.4:9000]", fmt.Sprint(addrsOf(state)); want != have {
+		t.Fatalf("addresses in panic mode: want %s, have %s", want, have)
+	}
+	if !r.Panicking() {
+		t.Fatal("want Resolver in panic mode")
+	}
+
+	// Leave panic mode
+	c2.setStatus(StatusHealthy)
+	for {
+		state = cc.waitForState(t)
+		if len(state.Addresses) != 4 {
+			break
+		}
+	}
+	if want, have := "[10.0.0.2:9000 10.0.0.3:9000 10.0.0.4:9000]", fmt.Sprint(addrsOf(state)); want != have {
+		t.Fatalf("addresses: want %s, have %s", want, have)
+	}
+	if r.Panicking() {
+		t.Fatal("want Resolver not in panic mode")
+	}
+}
+
+func TestResolverWithPanicThresholdAndNoHealthyEndpoints(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	b := NewBuilder(
+		SetEndpoints(
+			Endpoint{Addr: "10.0.0.1:9000", Checker: &testChecker{status: StatusUnhealthy}},
+			Endpoint{Addr: "10.0.0.2:9000", Checker: &testChecker{status: StatusUnhealthy}},
+		),
+		SetPanicThreshold(1),
+		SetUpdateInterval(1*time.Hour),
+	)
+	cc := newTestClientConn()
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+
+	state := cc.waitForState(t)
+	if want, have := "[10.0.0.1:9000 10.0.0.2:9000]", fmt.Sprint(addrsOf(state)); want != have {
+		t.Fatalf("addresses in panic mode: want %s, have %s", want, have)
+	}
+}
+
+// testLogger implements Logger and records the messages.
+type testLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+// contains returns true if a message contains s.
+func (l *testLogger) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, msg := range l.messages {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPanicModeIsLogged(t *testing.T) {
+	logger := &testLogger{}
+	ep := &Endpoint{Addr: "10.0.0.1:9000", status: StatusUnhealthy}
+	r := &Resolver{panicThreshold: 50, endp: []*Endpoint{ep}}
+	if err := SetLogger(logger)(r); err != nil {
+		t.Fatal(err)
+	}
+
+	r.updatePanicMode()
+	if want := "entering panic mode with 0 of 1 endpoints healthy"; !logger.contains(want) {
+		t.Fatalf("want log to contain %q, have %q", want, logger.messages)
+	}
+	ep.status = StatusHealthy
+	r.updatePanicMode()
+	if want := "leaving panic mode with 1 of 1 endpoints healthy"; !logger.contains(want) {
+		t.Fatalf("want log to contain %q, have %q", want, logger.messages)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package healthz
+
+import (
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// SetJitter specifies by which fraction the interval between two
+// health checks of an endpoint varies randomly, e.g. 0.1 for up to ±10%.
+// Together with a random delay after the first check of every endpoint,
+// this prevents all endpoints from being checked at the same time.
+// It defaults to 0.1.
+func SetJitter(fraction float64) ResolverOption {
+	return func(r *Resolver) error {
+		r.jitter = fraction
+		return nil
+	}
+}
+
+// SetMaxConcurrentChecks limits the number of health checks that run at
+// the same time. If the limit is reached, further checks wait until a
+// running check finishes. Use 0 to disable the limit. It defaults to 64.
+func SetMaxConcurrentChecks(n int) ResolverOption {
+	return func(r *Resolver) error {
+		r.maxChecks = n
+		return nil
+	}
+}
+
+// intervalOf returns the check interval of ep.
+func (r *Resolver) intervalOf(ep *Endpoint) time.Duration {
+	if ep.Interval > 0 {
+		return ep.Interval
+	}
+	return r.updateInterval
+}
+
+// timeoutOf returns the check timeout of ep.
+func (r *Resolver) timeoutOf(ep *Endpoint) time.Duration {
+	if ep.Timeout > 0 {
+		return ep.Timeout
+	}
+	return r.checkTimeout
+}
+
+// randomDelay returns a random delay between 0 and the check interval
+// of ep, to spread the checks of all endpoints over the interval.
+func (r *Resolver) randomDelay(ep *Endpoint) time.Duration {
+	interval := r.intervalOf(ep)
+	if interval <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(interval)))
+}
+
+// nextDelay returns the interval until the next check of ep,
+// varied randomly by the jitter.
+func (r *Resolver) nextDelay(ep *Endpoint) time.Duration {
+	interval := r.intervalOf(ep)
+	if r.jitter <= 0 {
+		return interval
+	}
+	delta := (rand.Float64()*2 - 1) * r.jitter * float64(interval)
+	return interval + time.Duration(delta)
+}
+
+// startEndpoint starts the schedule of ep with its first check after
+// the given delay, and watches ep if it has a GRPCChecker. The second
+// check follows after a random delay, see randomDelay. If checked is
+// not nil, the scheduler signals the first check on it.
+func (r *Resolver) startEndpoint(ep *Endpoint, delay time.Duration, checked chan<- struct{}) {
+	r.startWatcher(ep)
+	r.spawn(func() { r.scheduler(ep, delay, checked) })
+}
+
+// scheduler is a background process started for every endpoint. It checks
+// the endpoint in its own interval until the endpoint is removed or the
+// Resolver is closed, and pushes the healthy endpoints to the ClientConn
+// as soon as the endpoint changes its status.
+func (r *Resolver) scheduler(ep *Endpoint, delay time.Duration, checked chan<- struct{}) {
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	for first := true; ; first = false {
+		select {
+		case <-ep.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		status := r.probe(ep)
+		r.mu.Lock()
+		if ep.ctx.Err() != nil {
+			// Resolver has been closed or ep has been removed
+			r.mu.Unlock()
+			return
+		}
+		var changed bool
+		if status != StatusUnknown {
+			changed = r.record(ep, status, time.Now())
+		}
+		// Push the increasing weight of endpoints in slow start
+		rampingUp := ep.healthy() && ep.rampingUp
+		// newResolver pushes the results of the initial checks
+		initialized := r.initialized
+		r.mu.Unlock()
+
+		if initialized && (changed || rampingUp) {
+			r.updateState()
+		}
+		if first {
+			if checked != nil {
+				checked <- struct{}{}
+			}
+			t.Reset(r.randomDelay(ep))
+		} else {
+			t.Reset(r.nextDelay(ep))
+		}
+	}
+}
+
+// probe runs a single health check of ep within its timeout. It returns
+// StatusUnknown if ep has not been checked, e.g. because a Watch stream
+// reports its status.
+func (r *Resolver) probe(ep *Endpoint) Status {
+	r.mu.Lock()
+	watching := ep.watching
+	r.mu.Unlock()
+	if watching {
+		// The Watch stream reports the status of ep
+		return StatusUnknown
+	}
+
+	if r.sem != nil {
+		select {
+		case r.sem <- struct{}{}:
+			defer func() { <-r.sem }()
+		case <-ep.ctx.Done():
+			return StatusUnknown
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ep.ctx, r.timeoutOf(ep))
+	defer cancel()
+	status, err := ep.Checker.Check(ctx, ep)
+	if ep.ctx.Err() != nil {
+		return StatusUnknown
+	}
+	if err != nil {
+		// Mark endpoint as unhealthy
+		r.logger.Printf("grpc/lb/healthz: health check of %s failed: %v", ep.Addr, err)
+		return StatusUnhealthy
+	}
+	return status
+}
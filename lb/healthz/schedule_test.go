@@ -0,0 +1,132 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package healthz
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/resolver"
+)
+
+// blockingChecker is a Checker that blocks until the check times out.
+type blockingChecker struct{}
+
+func (blockingChecker) Check(ctx context.Context, ep *Endpoint) (Status, error) {
+	<-ctx.Done()
+	return StatusUnhealthy, ctx.Err()
+}
+
+// countingChecker is a Checker that records the maximum number of
+// concurrent checks.
+type countingChecker struct {
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (c *countingChecker) Check(ctx context.Context, ep *Endpoint) (Status, error) {
+	c.mu.Lock()
+	c.running++
+	if c.running > c.max {
+		c.max = c.running
+	}
+	c.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	c.mu.Lock()
+	c.running--
+	c.mu.Unlock()
+	return StatusHealthy, nil
+}
+
+func TestNextDelay(t *testing.T) {
+	r := &Resolver{updateInterval: 10 * time.Second, jitter: 0.1}
+	ep := &Endpoint{}
+	for i := 0; i < 100; i++ {
+		d := r.nextDelay(ep)
+		if d < 9*time.Second || d > 11*time.Second {
+			t.Fatalf("want delay between 9s and 11s, have %v", d)
+		}
+		if d := r.randomDelay(ep); d < 0 || d >= 10*time.Second {
+			t.Fatalf("want random delay between 0s and 10s, have %v", d)
+		}
+	}
+
+	ep.Interval = 1 * time.Second
+	r.jitter = 0
+	if want, have := 1*time.Second, r.nextDelay(ep); want != have {
+		t.Fatalf("want delay %v, have %v", want, have)
+	}
+}
+
+func TestResolverWithSlowEndpoint(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	c := &testChecker{status: StatusHealthy}
+	b := NewBuilder(
+		SetEndpoints(
+			Endpoint{Addr: "10.0.0.1:9000", Checker: c, Interval: 20 * time.Millisecond},
+			Endpoint{Addr: "10.0.0.2:9000", Checker: blockingChecker{}, Timeout: 1 * time.Hour},
+		),
+		SetCheckTimeout(100*time.Millisecond),
+	)
+	cc := newTestClientConn()
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+
+	state := cc.waitForState(t)
+	if want, have := "[10.0.0.1:9000]", fmt.Sprint(addrsOf(state)); want != have {
+		t.Fatalf("addresses: want %s, have %s", want, have)
+	}
+
+	// The blocking checks of the 2nd endpoint must not delay the 1st
+	c.setStatus(StatusUnhealthy)
+	select {
+	case state = <-cc.statec:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for resolver state")
+	}
+	if want, have := 0, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+}
+
+func TestResolverWithMaxConcurrentChecks(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	c := &countingChecker{}
+	var endpoints []Endpoint
+	for i := 0; i < 10; i++ {
+		endpoints = append(endpoints, Endpoint{Addr: fmt.Sprintf("10.0.0.%d:9000", i), Checker: c})
+	}
+	b := NewBuilder(
+		SetEndpoints(endpoints...),
+		SetMaxConcurrentChecks(3),
+		SetUpdateInterval(10*time.Millisecond),
+	)
+	cc := newTestClientConn()
+	res, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	res.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.max > 3 {
+		t.Fatalf("want at most 3 concurrent checks, have %d", c.max)
+	}
+}
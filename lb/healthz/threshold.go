@@ -0,0 +1,190 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package healthz
+
+import (
+	"math"
+	"time"
+)
+
+// slowStartSteps is the factor by which weights are scaled when slow start
+// is enabled, so the weight of a recovered endpoint can ramp up in steps.
+const slowStartSteps = 10
+
+// SetRise specifies the number of consecutive successful health checks
+// after which an unhealthy endpoint is considered healthy again, like
+// the rise parameter of HAProxy. It defaults to 1. Use the Rise field
+// of an Endpoint to override it per endpoint.
+//
+// The first health check of an endpoint decides its initial status
+// regardless of the thresholds.
+func SetRise(n int) ResolverOption {
+	return func(r *Resolver) error {
+		r.rise = n
+		return nil
+	}
+}
+
+// SetFall specifies the number of consecutive failed health checks
+// after which a healthy endpoint is considered unhealthy, like the fall
+// parameter of HAProxy. It defaults to 1. Use the Fall field of an
+// Endpoint to override it per endpoint.
+func SetFall(n int) ResolverOption {
+	return func(r *Resolver) error {
+		r.fall = n
+		return nil
+	}
+}
+
+// SetSlowStart specifies the period in which the weight of an endpoint
+// ramps up linearly after it has become healthy again, so it doesn't get
+// its full share of traffic right away. The weight is updated with every
+// health check. Slow start only has an effect with a balancer that
+// respects weights, see package weighted. It is disabled by default.
+// Use the SlowStart field of an Endpoint to override it per endpoint.
+func SetSlowStart(d time.Duration) ResolverOption {
+	return func(r *Resolver) error {
+		r.slowStart = d
+		return nil
+	}
+}
+
+// Status returns the current status of the endpoint.
+func (ep *Endpoint) Status() Status {
+	return ep.status
+}
+
+// ConsecutiveSuccesses returns the number of consecutive successful
+// health checks of the endpoint.
+func (ep *Endpoint) ConsecutiveSuccesses() int {
+	return ep.successes
+}
+
+// ConsecutiveFailures returns the number of consecutive failed
+// health checks of the endpoint.
+func (ep *Endpoint) ConsecutiveFailures() int {
+	return ep.failures
+}
+
+// LastChange returns the time the status of the endpoint last changed.
+func (ep *Endpoint) LastChange() time.Time {
+	return ep.lastChange
+}
+
+// InSlowStart returns true while the weight of the endpoint ramps up
+// after it has become healthy again, see SetSlowStart.
+func (ep *Endpoint) InSlowStart() bool {
+	return ep.rampingUp
+}
+
+// record records the result of a health check of ep, applies the rise
+// and fall thresholds, and reports whether ep has changed from healthy
+// to unhealthy or vice versa. The caller must hold r.mu.
+func (r *Resolver) record(ep *Endpoint, status Status, now time.Time) bool {
+	if status == StatusHealthy {
+		ep.successes++
+		ep.failures = 0
+	} else {
+		ep.failures++
+		ep.successes = 0
+	}
+
+	switch ep.status {
+	case StatusHealthy:
+		if ep.failures >= r.fallOf(ep) {
+			return r.transition(ep, StatusUnhealthy, now)
+		}
+	case StatusUnhealthy:
+		if ep.successes >= r.riseOf(ep) {
+			return r.transition(ep, StatusHealthy, now)
+		}
+	default:
+		// The first health check decides the initial status
+		return r.transition(ep, status, now)
+	}
+	return false
+}
+
+// transition sets the status of ep and reports whether ep has changed
+// from healthy to unhealthy or vice versa. The caller must hold r.mu.
+func (r *Resolver) transition(ep *Endpoint, status Status, now time.Time) bool {
+	if ep.status == status {
+		return false
+	}
+	wasHealthy := ep.healthy()
+	ep.rampingUp = ep.status == StatusUnhealthy && status == StatusHealthy && r.slowStartOf(ep) > 0
+	ep.status = status
+	ep.lastChange = now
+	return wasHealthy != ep.healthy()
+}
+
+// riseOf returns the rise threshold of ep.
+func (r *Resolver) riseOf(ep *Endpoint) int {
+	if ep.Rise > 0 {
+		return ep.Rise
+	}
+	return r.rise
+}
+
+// fallOf returns the fall threshold of ep.
+func (r *Resolver) fallOf(ep *Endpoint) int {
+	if ep.Fall > 0 {
+		return ep.Fall
+	}
+	return r.fall
+}
+
+// slowStartOf returns the slow start period of ep.
+func (r *Resolver) slowStartOf(ep *Endpoint) time.Duration {
+	if ep.SlowStart > 0 {
+		return ep.SlowStart
+	}
+	return r.slowStart
+}
+
+// usesSlowStart returns true if slow start is enabled for any endpoint.
+// The caller must hold r.mu.
+func (r *Resolver) usesSlowStart() bool {
+	if r.slowStart > 0 {
+		return true
+	}
+	for _, ep := range r.endp {
+		if ep.SlowStart > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// weight returns the weight to pass to the balancer for ep. If scale is
+// true, weights are scaled by slowStartSteps and the weight of endpoints
+// in slow start is reduced in proportion to the elapsed time. Endpoints
+// that have finished slow start get their full weight. The caller must
+// hold r.mu.
+func (r *Resolver) weight(ep *Endpoint, scale bool, now time.Time) uint32 {
+	if !scale {
+		return ep.Weight
+	}
+	weight := uint64(ep.Weight)
+	if weight == 0 {
+		weight = 1
+	}
+	weight *= slowStartSteps
+	if ep.rampingUp {
+		elapsed, period := now.Sub(ep.lastChange), r.slowStartOf(ep)
+		if elapsed < period {
+			weight = uint64(float64(weight) * float64(elapsed) / float64(period))
+			if weight == 0 {
+				weight = 1
+			}
+		} else {
+			ep.rampingUp = false
+		}
+	}
+	if weight > math.MaxUint32 {
+		weight = math.MaxUint32
+	}
+	return uint32(weight)
+}
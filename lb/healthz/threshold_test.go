@@ -0,0 +1,271 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package healthz
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/olivere/grpc/lb/weighted"
+)
+
+func TestRecord(t *testing.T) {
+	const (
+		H = StatusHealthy
+		U = StatusUnhealthy
+	)
+	tests := []struct {
+		Rise    int
+		Fall    int
+		Checks  []Status
+		Status  []Status
+		Changed []bool
+	}{
+		// Default thresholds: every check decides
+		{
+			Rise:    1,
+			Fall:    1,
+			Checks:  []Status{H, U, H, H},
+			Status:  []Status{H, U, H, H},
+			Changed: []bool{true, true, true, false},
+		},
+		// The first check decides, regardless of the thresholds
+		{
+			Rise:    3,
+			Fall:    2,
+			Checks:  []Status{U, H, H, H, U, H, U, U},
+			Status:  []Status{U, U, U, H, H, H, H, U},
+			Changed: []bool{false, false, false, true, false, false, false, true},
+		},
+		{
+			Rise:    2,
+			Fall:    2,
+			Checks:  []Status{H, U, H, U, U, H, U, H, H},
+			Status:  []Status{H, H, H, H, U, U, U, U, H},
+			Changed: []bool{true, false, false, false, true, false, false, false, true},
+		},
+	}
+	for i, tt := range tests {
+		r := &Resolver{rise: tt.Rise, fall: tt.Fall}
+		ep := &Endpoint{}
+		for j, check := range tt.Checks {
+			changed := r.record(ep, check, time.Now())
+			if want, have := tt.Status[j], ep.Status(); want != have {
+				t.Errorf("#%d: check %d: want status %v, have %v", i, j, want, have)
+			}
+			if want, have := tt.Changed[j], changed; want != have {
+				t.Errorf("#%d: check %d: want changed %v, have %v", i, j, want, have)
+			}
+		}
+	}
+}
+
+func TestRecordWithEndpointThresholds(t *testing.T) {
+	r := &Resolver{rise: 1, fall: 1}
+	ep := &Endpoint{Fall: 3}
+	r.record(ep, StatusHealthy, time.Now())
+	r.record(ep, StatusUnhealthy, time.Now())
+	r.record(ep, StatusUnhealthy, time.Now())
+	if want, have := StatusHealthy, ep.Status(); want != have {
+		t.Fatalf("want status %v, have %v", want, have)
+	}
+	if want, have := 2, ep.ConsecutiveFailures(); want != have {
+		t.Fatalf("want %d consecutive failures, have %d", want, have)
+	}
+	r.record(ep, StatusUnhealthy, time.Now())
+	if want, have := StatusUnhealthy, ep.Status(); want != have {
+		t.Fatalf("want status %v, have %v", want, have)
+	}
+}
+
+func TestWeightWithSlowStart(t *testing.T) {
+	r := &Resolver{rise: 1, fall: 1, slowStart: 10 * time.Second}
+	start := time.Now()
+	ep := &Endpoint{Weight: 2}
+	r.record(ep, StatusHealthy, start)
+
+	// Initially healthy endpoints get their full weight right away
+	if ep.InSlowStart() {
+		t.Fatal("want endpoint not in slow start")
+	}
+	if want, have := uint32(20), r.weight(ep, true, start); want != have {
+		t.Fatalf("want weight %d, have %d", want, have)
+	}
+	if want, have := uint32(2), r.weight(ep, false, start); want != have {
+		t.Fatalf("want weight %d, have %d", want, have)
+	}
+
+	// Recovered endpoints ramp up
+	r.record(ep, StatusUnhealthy, start)
+	r.record(ep, StatusHealthy, start)
+	if !ep.InSlowStart() {
+		t.Fatal("want endpoint in slow start")
+	}
+	if want, have := uint32(1), r.weight(ep, true, start); want != have {
+		t.Fatalf("want weight %d, have %d", want, have)
+	}
+	if want, have := uint32(5), r.weight(ep, true, start.Add(2500*time.Millisecond)); want != have {
+		t.Fatalf("want weight %d, have %d", want, have)
+	}
+	if want, have := uint32(20), r.weight(ep, true, start.Add(10*time.Second)); want != have {
+		t.Fatalf("want weight %d, have %d", want, have)
+	}
+	if ep.InSlowStart() {
+		t.Fatal("want endpoint to finish slow start")
+	}
+}
+
+func TestResolverWithThresholds(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	c := &testChecker{status: StatusHealthy}
+	b := NewBuilder(
+		SetEndpoints(
+			Endpoint{Addr: "10.0.0.1:9000", Checker: c},
+			Endpoint{Addr: "10.0.0.2:9000", Checker: &testChecker{status: StatusHealthy}},
+		),
+		SetRise(2),
+		SetFall(2),
+		SetSlowStart(1*time.Hour),
+		SetUpdateInterval(50*time.Millisecond),
+		SetCheckTimeout(1*time.Second),
+	)
+	cc := newTestClientConn()
+	r, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	state := cc.waitForState(t)
+	if want, have := 2, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+
+	c.setStatus(StatusUnhealthy)
+	state = cc.waitForState(t)
+	if want, have := 1, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+	endpoints := r.(*Resolver).Endpoints()
+	if want, have := StatusUnhealthy, endpoints[0].Status(); want != have {
+		t.Fatalf("want status %v, have %v", want, have)
+	}
+	if have := endpoints[0].ConsecutiveFailures(); have < 2 {
+		t.Fatalf("want at least 2 consecutive failures, have %d", have)
+	}
+
+	// The recovered endpoint starts with a low weight
+	c.setStatus(StatusHealthy)
+	state = cc.waitForState(t)
+	if want, have := 2, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+	for _, addr := range state.Addresses {
+		want := uint32(slowStartSteps)
+		if addr.Addr == "10.0.0.1:9000" {
+			want = 1
+		}
+		if have := weighted.Weight(addr); want != have {
+			t.Errorf("%s: want weight %d, have %d", addr.Addr, want, have)
+		}
+	}
+	if !r.(*Resolver).Endpoints()[0].InSlowStart() {
+		t.Fatal("want endpoint in slow start")
+	}
+}
+
+func TestSlowStartWithBalancer(t *testing.T) {
+	// Start servers that report their address in a header
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := lis.Addr().String()
+		srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			grpc.SetHeader(ctx, metadata.Pairs("server", addr))
+			return handler(ctx, req)
+		}))
+		healthpb.RegisterHealthServer(srv, health.NewServer())
+		go srv.Serve(lis)
+		defer srv.Stop()
+		addrs = append(addrs, addr)
+	}
+
+	c := &testChecker{status: StatusHealthy}
+	b := NewBuilder(
+		SetEndpoints(
+			Endpoint{Addr: addrs[0], Checker: c},
+			Endpoint{Addr: addrs[1], Checker: &testChecker{status: StatusHealthy}},
+		),
+		SetSlowStart(2*time.Second),
+		SetUpdateInterval(50*time.Millisecond),
+		SetCheckTimeout(1*time.Second),
+	)
+	conn, err := grpc.NewClient(Scheme+":///",
+		grpc.WithResolvers(b),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"smooth_weighted_round_robin":{}}]}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	// share returns the number of RPCs out of 100 that reach addrs[0]
+	share := func() int {
+		var n int
+		for i := 0; i < 100; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			var header metadata.MD
+			_, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true), grpc.Header(&header))
+			cancel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Get("server")[0] == addrs[0] {
+				n++
+			}
+		}
+		return n
+	}
+	// waitForShare waits until the share of addrs[0] is between min and max
+	waitForShare := func(min, max int) {
+		t.Helper()
+		var have int
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if have = share(); have >= min && have <= max {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("share of %s: want %d-%d, have %d", addrs[0], min, max, have)
+	}
+
+	waitForShare(50, 50)
+	c.setStatus(StatusUnhealthy)
+	waitForShare(0, 0)
+
+	// The recovered endpoint gets a small share first, and its full
+	// share after the slow start period
+	c.setStatus(StatusHealthy)
+	waitForShare(1, 30)
+	waitForShare(50, 50)
+}
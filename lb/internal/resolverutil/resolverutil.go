@@ -0,0 +1,83 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+// Package resolverutil contains helpers shared by the resolvers that
+// watch an external service, i.e. the Consul and DNS SRV resolvers.
+package resolverutil
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/resolver"
+)
+
+// Wait waits for the given duration or until ctx is done.
+// It returns false if ctx is done.
+func Wait(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// Backoff returns the duration to wait before the given retry. It starts
+// at base and doubles with every retry up to max. A random jitter of up
+// to 50% is subtracted from every duration.
+func Backoff(base, max time.Duration, retries int) time.Duration {
+	d := base
+	for i := 1; i < retries && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// ReportError logs err with the given message, which should start with
+// the prefix of the package, and reports it to cc.
+func ReportError(cc resolver.ClientConn, msg string, err error) {
+	log.Printf("%s: %v", msg, err)
+	cc.ReportError(err)
+}
+
+// MakeUpdates calculates the difference between an old and a new set of
+// addresses and returns the addresses that were added and deleted.
+// An address whose attributes have changed is both deleted and added.
+func MakeUpdates(oldAddrs, newAddrs []resolver.Address) (added, deleted []resolver.Address) {
+	oldAddr := make(map[string]resolver.Address, len(oldAddrs))
+	for _, addr := range oldAddrs {
+		oldAddr[addr.Addr] = addr
+	}
+	newAddr := make(map[string]resolver.Address, len(newAddrs))
+	for _, addr := range newAddrs {
+		newAddr[addr.Addr] = addr
+	}
+
+	for key, addr := range newAddr {
+		if old, ok := oldAddr[key]; !ok || !old.Equal(addr) {
+			added = append(added, addr)
+		}
+	}
+	for key, addr := range oldAddr {
+		if cur, ok := newAddr[key]; !ok || !cur.Equal(addr) {
+			deleted = append(deleted, addr)
+		}
+	}
+
+	return added, deleted
+}
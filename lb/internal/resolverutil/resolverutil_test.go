@@ -0,0 +1,101 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package resolverutil
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestWait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if !Wait(ctx, 0) {
+		t.Fatal("Wait(0): want true, have false")
+	}
+	if !Wait(ctx, 10*time.Millisecond) {
+		t.Fatal("Wait: want true, have false")
+	}
+	cancel()
+	start := time.Now()
+	if Wait(ctx, 1*time.Hour) {
+		t.Fatal("Wait after cancel: want false, have true")
+	}
+	if d := time.Since(start); d > 1*time.Second {
+		t.Fatalf("Wait after cancel: want to return immediately, took %v", d)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		Retries int
+		Max     time.Duration
+	}{
+		{1, 1 * time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			d := Backoff(1*time.Second, 10*time.Second, tt.Retries)
+			if d > tt.Max || d < tt.Max/2 {
+				t.Fatalf("Backoff(%d): want between %v and %v, have %v", tt.Retries, tt.Max/2, tt.Max, d)
+			}
+		}
+	}
+}
+
+// withVersion returns a copy of addr with the given version attribute.
+func withVersion(addr string, version string) resolver.Address {
+	return resolver.Address{Addr: addr, BalancerAttributes: attributes.New("version", version)}
+}
+
+func TestMakeUpdates(t *testing.T) {
+	a := withVersion("10.0.0.1:9000", "v1")
+	b := withVersion("10.0.0.2:9000", "v1")
+	b2 := withVersion("10.0.0.2:9000", "v2")
+	c := withVersion("10.0.0.3:9000", "v1")
+
+	tests := []struct {
+		Old, New       []resolver.Address
+		Added, Deleted []resolver.Address
+	}{
+		{nil, nil, nil, nil},
+		{nil, []resolver.Address{a}, []resolver.Address{a}, nil},
+		{[]resolver.Address{a}, []resolver.Address{a}, nil, nil},
+		{[]resolver.Address{a, b}, []resolver.Address{a, c}, []resolver.Address{c}, []resolver.Address{b}},
+		// Changed attributes result in both a delete and an add
+		{[]resolver.Address{a, b}, []resolver.Address{a, b2}, []resolver.Address{b2}, []resolver.Address{b}},
+		{[]resolver.Address{a}, nil, nil, []resolver.Address{a}},
+	}
+	for i, tt := range tests {
+		added, deleted := MakeUpdates(tt.Old, tt.New)
+		if !equal(tt.Added, added) {
+			t.Errorf("#%d: added: want %v, have %v", i, tt.Added, added)
+		}
+		if !equal(tt.Deleted, deleted) {
+			t.Errorf("#%d: deleted: want %v, have %v", i, tt.Deleted, deleted)
+		}
+	}
+}
+
+// equal returns true if a and b contain the same addresses.
+func equal(a, b []resolver.Address) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
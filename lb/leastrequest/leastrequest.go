@@ -0,0 +1,196 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+// Package leastrequest implements balancers for gRPC that take the number
+// of outstanding RPCs of every address into account. They work better
+// than round-robin if the latency of the RPCs varies a lot between
+// backends, as slow backends automatically get fewer RPCs.
+//
+// Two balancers are registered:
+//
+//   - "least_request" sends every RPC to the address with the fewest
+//     outstanding RPCs.
+//   - "p2c" picks two random addresses and sends the RPC to the one
+//     with fewer outstanding RPCs ("power of two choices"). It spreads
+//     RPCs more evenly than least_request when many clients share the
+//     same backends, and needs constant time per pick.
+//
+// Both balancers respect the weights attached with weighted.SetWeight:
+// An address with weight 2 is treated as if it had half the outstanding
+// RPCs. Select them via the service config, e.g.:
+//
+//	grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"p2c":{}}]}`)
+package leastrequest
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+
+	"github.com/olivere/grpc/lb/weighted"
+)
+
+const (
+	// Name is the name the least request balancer is registered with in gRPC.
+	Name = "least_request"
+	// P2CName is the name the power of two choices balancer is registered
+	// with in gRPC.
+	P2CName = "p2c"
+)
+
+func init() {
+	balancer.Register(&builder{name: Name, choose: leastRequest})
+	balancer.Register(&builder{name: P2CName, choose: powerOfTwoChoices})
+}
+
+// chooseFunc chooses one of the items of a picker. It must not modify items.
+type chooseFunc func(p *picker) *item
+
+// builder creates balancers. Every balancer, i.e. every gRPC client
+// connection, counts the outstanding RPCs of its SubConns separately.
+type builder struct {
+	name   string
+	choose chooseFunc
+}
+
+// Name returns the name of the balancer.
+func (b *builder) Name() string {
+	return b.name
+}
+
+// Build creates a new balancer for cc.
+func (b *builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &pickerBuilder{choose: b.choose}
+	return weighted.NewBalancerBuilder(b.name, pb, base.Config{}).Build(cc, opts)
+}
+
+// NewPickerBuilder returns the picker builder of the least request
+// balancer, e.g. to wrap it with outlier detection (see package outlier).
+func NewPickerBuilder() base.PickerBuilder {
+	return &pickerBuilder{choose: leastRequest}
+}
+
+// NewP2CPickerBuilder returns the picker builder of the power of two
+// choices balancer, e.g. to wrap it with outlier detection (see package
+// outlier).
+func NewP2CPickerBuilder() base.PickerBuilder {
+	return &pickerBuilder{choose: powerOfTwoChoices}
+}
+
+// pickerBuilder creates pickers from the ready SubConns. It keeps the
+// number of outstanding RPCs of every SubConn across pickers, so RPCs
+// that finish after a new picker was built are still accounted for.
+// A pickerBuilder can be shared between balancers.
+type pickerBuilder struct {
+	choose chooseFunc
+
+	mu          sync.Mutex
+	outstanding map[balancer.SubConn]*int64
+}
+
+// Build creates a new picker.
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.outstanding == nil {
+		b.outstanding = make(map[balancer.SubConn]*int64)
+	}
+	for sc, n := range b.outstanding {
+		// Forget SubConns that are gone, or belong to another balancer,
+		// once their RPCs are done
+		if _, found := info.ReadySCs[sc]; !found && atomic.LoadInt64(n) == 0 {
+			delete(b.outstanding, sc)
+		}
+	}
+	for sc := range info.ReadySCs {
+		if _, found := b.outstanding[sc]; !found {
+			b.outstanding[sc] = new(int64)
+		}
+	}
+
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	p := &picker{choose: b.choose}
+	for sc, sci := range info.ReadySCs {
+		p.items = append(p.items, &item{
+			sc:          sc,
+			weight:      float64(weighted.Weight(sci.Address)),
+			outstanding: b.outstanding[sc],
+		})
+	}
+	return p
+}
+
+// item is a SubConn with its weight and number of outstanding RPCs.
+type item struct {
+	sc          balancer.SubConn
+	weight      float64
+	outstanding *int64
+}
+
+// load returns the number of outstanding RPCs of it relative to its
+// weight, including the RPC about to be picked.
+func (it *item) load() float64 {
+	return float64(atomic.LoadInt64(it.outstanding)+1) / it.weight
+}
+
+// picker picks the SubConn chosen by choose, and counts the outstanding
+// RPCs of every SubConn.
+type picker struct {
+	choose chooseFunc
+	items  []*item
+	next   uint32 // for breaking ties in leastRequest
+}
+
+// Pick returns the SubConn to use for the next RPC.
+func (p *picker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	it := p.choose(p)
+	atomic.AddInt64(it.outstanding, 1)
+	return balancer.PickResult{
+		SubConn: it.sc,
+		Done: func(balancer.DoneInfo) {
+			atomic.AddInt64(it.outstanding, -1)
+		},
+	}, nil
+}
+
+// leastRequest chooses the item with the lowest load. Ties are broken
+// in round-robin order, so idle SubConns are used in turn.
+func leastRequest(p *picker) *item {
+	n := len(p.items)
+	start := int(atomic.AddUint32(&p.next, 1) % uint32(n))
+	best := p.items[start]
+	bestLoad := best.load()
+	for i := 1; i < n; i++ {
+		it := p.items[(start+i)%n]
+		if load := it.load(); load < bestLoad {
+			best, bestLoad = it, load
+		}
+	}
+	return best
+}
+
+// powerOfTwoChoices chooses two random items and returns the one with
+// the lower load.
+func powerOfTwoChoices(p *picker) *item {
+	n := len(p.items)
+	if n == 1 {
+		return p.items[0]
+	}
+	i := rand.Intn(n)
+	j := rand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	a, b := p.items[i], p.items[j]
+	if b.load() < a.load() {
+		return b
+	}
+	return a
+}
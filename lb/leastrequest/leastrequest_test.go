@@ -0,0 +1,173 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package leastrequest
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/olivere/grpc/lb/weighted"
+)
+
+// testSubConn implements balancer.SubConn for testing.
+type testSubConn struct {
+	balancer.SubConn // unimplemented methods panic
+
+	name string
+}
+
+// buildInfo returns the PickerBuildInfo for the given SubConns,
+// using the given weights.
+func buildInfo(scs []*testSubConn, weights ...uint32) base.PickerBuildInfo {
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for i, sc := range scs {
+		addr := resolver.Address{Addr: sc.name}
+		if i < len(weights) {
+			addr = weighted.SetWeight(addr, weights[i])
+		}
+		info.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+	}
+	return info
+}
+
+// pick picks a SubConn from p and returns its name and Done callback.
+func pick(t *testing.T, p balancer.Picker) (string, func()) {
+	t.Helper()
+	res, err := p.Pick(balancer.PickInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.SubConn.(*testSubConn).name, func() { res.Done(balancer.DoneInfo{}) }
+}
+
+func TestLeastRequest(t *testing.T) {
+	scs := []*testSubConn{{name: "sc1"}, {name: "sc2"}, {name: "sc3"}}
+	p := NewPickerBuilder().Build(buildInfo(scs))
+
+	// Idle SubConns are used in turn
+	var names []string
+	var dones []func()
+	for i := 0; i < 3; i++ {
+		name, done := pick(t, p)
+		names = append(names, name)
+		dones = append(dones, done)
+	}
+	if names[0] == names[1] || names[1] == names[2] || names[0] == names[2] {
+		t.Fatalf("want 3 different SubConns, have %v", names)
+	}
+
+	// The SubConn whose RPC is done gets the next RPC
+	dones[1]()
+	for i := 0; i < 3; i++ {
+		name, done := pick(t, p)
+		if want, have := names[1], name; want != have {
+			t.Fatalf("want %s, have %s", want, have)
+		}
+		done()
+	}
+}
+
+func TestLeastRequestWithWeights(t *testing.T) {
+	scs := []*testSubConn{{name: "sc1"}, {name: "sc2"}}
+	p := NewPickerBuilder().Build(buildInfo(scs, 3, 1))
+
+	// sc1 gets 3 outstanding RPCs for every outstanding RPC of sc2
+	picks := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		name, _ := pick(t, p)
+		picks[name]++
+	}
+	if want, have := 6, picks["sc1"]; want != have {
+		t.Fatalf("picks of sc1: want %d, have %d", want, have)
+	}
+	if want, have := 2, picks["sc2"]; want != have {
+		t.Fatalf("picks of sc2: want %d, have %d", want, have)
+	}
+}
+
+func TestPowerOfTwoChoices(t *testing.T) {
+	scs := []*testSubConn{{name: "sc1"}, {name: "sc2"}}
+	p := NewP2CPickerBuilder().Build(buildInfo(scs))
+
+	// With two SubConns, the one with fewer outstanding RPCs always wins
+	busy, _ := pick(t, p)
+	for i := 0; i < 10; i++ {
+		name, done := pick(t, p)
+		if name == busy {
+			t.Fatalf("want SubConn other than %s", busy)
+		}
+		done()
+	}
+
+	// A single SubConn is always picked
+	p = NewP2CPickerBuilder().Build(buildInfo(scs[:1]))
+	for i := 0; i < 3; i++ {
+		if name, _ := pick(t, p); name != "sc1" {
+			t.Fatalf("want sc1, have %s", name)
+		}
+	}
+}
+
+func TestPowerOfTwoChoicesSpreadsRequests(t *testing.T) {
+	scs := []*testSubConn{{name: "sc1"}, {name: "sc2"}, {name: "sc3"}, {name: "sc4"}}
+	p := NewP2CPickerBuilder().Build(buildInfo(scs))
+
+	// Without finished RPCs, the outstanding RPCs are spread evenly
+	picks := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		name, _ := pick(t, p)
+		picks[name]++
+	}
+	for _, sc := range scs {
+		if have := picks[sc.name]; have < 90 || have > 110 {
+			t.Errorf("picks of %s: want about 100, have %d", sc.name, have)
+		}
+	}
+}
+
+func TestOutstandingRequestsSurviveRebuild(t *testing.T) {
+	scs := []*testSubConn{{name: "sc1"}, {name: "sc2"}}
+	pb := NewPickerBuilder()
+	p := pb.Build(buildInfo(scs))
+	busy, done := pick(t, p)
+
+	// The new picker knows about the outstanding RPC
+	p = pb.Build(buildInfo(scs))
+	for i := 0; i < 3; i++ {
+		name, done := pick(t, p)
+		if name == busy {
+			t.Fatalf("want SubConn other than %s", busy)
+		}
+		done()
+	}
+	done()
+	if want, have := int64(0), *pb.(*pickerBuilder).outstanding[scs[0]]; want != have {
+		t.Fatalf("outstanding RPCs: want %d, have %d", want, have)
+	}
+
+	// SubConns that are gone are forgotten
+	pb.Build(buildInfo(scs[1:]))
+	if want, have := 1, len(pb.(*pickerBuilder).outstanding); want != have {
+		t.Fatalf("want %d SubConns, have %d", want, have)
+	}
+}
+
+func TestPickerWithoutSubConns(t *testing.T) {
+	p := NewPickerBuilder().Build(base.PickerBuildInfo{})
+	if _, err := p.Pick(balancer.PickInfo{}); err != balancer.ErrNoSubConnAvailable {
+		t.Fatalf("Pick: want %v, have %v", balancer.ErrNoSubConnAvailable, err)
+	}
+}
+
+func TestBalancersAreRegistered(t *testing.T) {
+	for _, name := range []string{Name, P2CName} {
+		if balancer.Get(name) == nil {
+			t.Errorf("want balancer %q to be registered", name)
+		}
+	}
+}
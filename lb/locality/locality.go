@@ -0,0 +1,278 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+// Package locality implements a zone-aware balancer for gRPC.
+//
+// The balancer prefers the addresses in the zone of the client, e.g. its
+// availability zone, to save the latency and cost of cross-zone traffic.
+// It only spills over to the other zones when the healthy capacity of the
+// local zone drops below a threshold, i.e. when the weight of the ready
+// local addresses is less than the given percentage of the weight of all
+// local addresses. Within the selected addresses, RPCs are distributed by
+// smooth weighted round-robin (see package weighted).
+//
+// Resolvers like the Consul and healthz resolvers remove unhealthy
+// addresses, so the balancer remembers local addresses for a while after
+// the resolver removed them, and counts them as unhealthy capacity. The
+// default of 10 minutes outlasts most outages of a single address, but
+// also means that the balancer may spill over to other zones for up to
+// 10 minutes after the local zone was scaled down. Configure a shorter
+// forget_after, or the capacity of the local zone explicitly, if addresses
+// come and go more often, e.g. with autoscaling.
+//
+// Resolvers attach zones to addresses with SetZone. The Consul resolver
+// uses the "zone" key of the node metadata (see consul.SetZoneKey), and
+// the healthz resolver the Zone of an Endpoint. For the static resolver,
+// pass the addresses with SetZone to SetAddresses.
+//
+// Select the balancer and configure the zone of the client via the
+// service config, e.g.:
+//
+//	grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"locality":{"zone":"us-east-1a","threshold":70}}]}`)
+//
+// The config has these settings:
+//
+//   - zone: the zone of the client; without a zone, all addresses are used
+//   - threshold: the percentage of healthy local capacity below which the
+//     balancer spills over to other zones (default: 50)
+//   - capacity: the total weight of the addresses in the zone of the client
+//     when all of them are healthy (default: the weight of the addresses
+//     the resolver returned within forget_after)
+//   - forget_after: how long to count addresses the resolver removed as
+//     unhealthy capacity, as a duration like "90s" or "5m" (default: "10m")
+package locality
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	"github.com/olivere/grpc/lb/weighted"
+)
+
+// Name is the name the balancer is registered with in gRPC.
+const Name = "locality"
+
+var (
+	defaultThreshold   = 50.0
+	defaultForgetAfter = 10 * time.Minute
+)
+
+func init() {
+	balancer.Register(&builder{})
+}
+
+// zoneKey is the key for the zone in the balancer attributes
+// of a resolver.Address.
+type zoneKey struct{}
+
+// SetZone returns a copy of addr with the given zone attached.
+func SetZone(addr resolver.Address, zone string) resolver.Address {
+	addr.BalancerAttributes = addr.BalancerAttributes.WithValue(zoneKey{}, zone)
+	return addr
+}
+
+// Zone returns the zone attached to addr, or an empty string if addr
+// has no zone.
+func Zone(addr resolver.Address) string {
+	zone, _ := addr.BalancerAttributes.Value(zoneKey{}).(string)
+	return zone
+}
+
+// config is the configuration of the balancer in the service config.
+type config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	Zone      string   `json:"zone,omitempty"`
+	Threshold *float64 `json:"threshold,omitempty"`
+	Capacity  uint64   `json:"capacity,omitempty"`
+
+	ForgetAfter string        `json:"forget_after,omitempty"`
+	forgetAfter time.Duration // parsed ForgetAfter, or 0
+}
+
+// builder creates balancers and parses their configuration.
+type builder struct{}
+
+// Name returns the name of the balancer.
+func (*builder) Name() string {
+	return Name
+}
+
+// Build creates a new balancer for cc.
+func (*builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := newPickerBuilder(weighted.NewPickerBuilder())
+	return &localityBalancer{
+		Balancer: weighted.NewBalancerBuilder(Name, pb, base.Config{}).Build(cc, opts),
+		pb:       pb,
+	}
+}
+
+// ParseConfig parses the configuration of the balancer in the service config.
+func (*builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	cfg := &config{}
+	if err := json.Unmarshal(js, cfg); err != nil {
+		return nil, fmt.Errorf("grpc/lb/locality: unable to parse config: %v", err)
+	}
+	if cfg.Threshold != nil && (*cfg.Threshold < 0 || *cfg.Threshold > 100) {
+		return nil, fmt.Errorf("grpc/lb/locality: threshold must be between 0 and 100, have %v", *cfg.Threshold)
+	}
+	if cfg.ForgetAfter != "" {
+		d, err := time.ParseDuration(cfg.ForgetAfter)
+		if err != nil {
+			return nil, fmt.Errorf("grpc/lb/locality: unable to parse forget_after: %v", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("grpc/lb/locality: forget_after must be positive, have %v", d)
+		}
+		cfg.forgetAfter = d
+	}
+	return cfg, nil
+}
+
+// localityBalancer passes the configuration from the service config and
+// the capacity of the zones from the resolver to the picker builder.
+type localityBalancer struct {
+	balancer.Balancer
+	pb *pickerBuilder
+}
+
+// UpdateClientConnState is called by gRPC when the state of the
+// ClientConn changes.
+func (b *localityBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	b.pb.update(s.BalancerConfig, s.ResolverState.Addresses)
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+// pickerBuilder creates pickers from the ready SubConns in the zone of
+// the client, or from all ready SubConns if the zone has too little
+// healthy capacity.
+type pickerBuilder struct {
+	pb          base.PickerBuilder
+	forgetAfter time.Duration
+	now         func() time.Time
+
+	mu        sync.Mutex
+	zone      string
+	threshold float64
+	capacity  uint64                // configured capacity of zone, or 0
+	local     map[string]*localAddr // addresses in zone, by Addr
+	spilling  bool
+}
+
+// localAddr is an address in the zone of the client.
+type localAddr struct {
+	weight       uint32
+	removedSince time.Time // zero while the resolver returns the address
+}
+
+// newPickerBuilder creates a pickerBuilder that wraps pb.
+func newPickerBuilder(pb base.PickerBuilder) *pickerBuilder {
+	return &pickerBuilder{
+		pb:          pb,
+		forgetAfter: defaultForgetAfter,
+		now:         time.Now,
+		threshold:   defaultThreshold,
+		local:       make(map[string]*localAddr),
+	}
+}
+
+// update applies the configuration from the service config, and records
+// the addresses in the zone of the client. Addresses the resolver has
+// removed are kept for a while, as the resolver may have removed them
+// because they are unhealthy.
+func (b *pickerBuilder) update(cfg serviceconfig.LoadBalancingConfig, addrs []resolver.Address) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if cfg, ok := cfg.(*config); ok {
+		if cfg.Zone != b.zone {
+			b.local = make(map[string]*localAddr)
+		}
+		b.zone = cfg.Zone
+		b.threshold = defaultThreshold
+		if cfg.Threshold != nil {
+			b.threshold = *cfg.Threshold
+		}
+		b.capacity = cfg.Capacity
+		b.forgetAfter = defaultForgetAfter
+		if cfg.forgetAfter > 0 {
+			b.forgetAfter = cfg.forgetAfter
+		}
+	}
+	now := b.now()
+	current := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		if Zone(addr) != b.zone {
+			continue
+		}
+		current[addr.Addr] = true
+		b.local[addr.Addr] = &localAddr{weight: weighted.Weight(addr)}
+	}
+	for key, addr := range b.local {
+		if !current[key] && addr.removedSince.IsZero() {
+			addr.removedSince = now
+		}
+	}
+}
+
+// localCapacity returns the total weight of the addresses in the zone of
+// the client, either as configured or as seen recently. The caller must
+// hold b.mu.
+func (b *pickerBuilder) localCapacity() uint64 {
+	if b.capacity > 0 {
+		return b.capacity
+	}
+	now := b.now()
+	var capacity uint64
+	for key, addr := range b.local {
+		if !addr.removedSince.IsZero() && now.Sub(addr.removedSince) >= b.forgetAfter {
+			delete(b.local, key)
+			continue
+		}
+		capacity += uint64(addr.weight)
+	}
+	return capacity
+}
+
+// Build creates a new picker.
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.zone == "" {
+		return b.pb.Build(info)
+	}
+	local := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	var healthy uint64
+	for sc, sci := range info.ReadySCs {
+		if Zone(sci.Address) == b.zone {
+			local.ReadySCs[sc] = sci
+			healthy += uint64(weighted.Weight(sci.Address))
+		}
+	}
+
+	capacity := b.localCapacity()
+	spilling := len(local.ReadySCs) == 0 || float64(healthy)*100 < b.threshold*float64(capacity)
+	if spilling && !b.spilling {
+		log.Printf("grpc/lb/locality: spilling over to other zones with %d of %d capacity healthy in zone %s", healthy, capacity, b.zone)
+	} else if !spilling && b.spilling {
+		log.Printf("grpc/lb/locality: using zone %s only with %d of %d capacity healthy", b.zone, healthy, capacity)
+	}
+	b.spilling = spilling
+	if spilling {
+		return b.pb.Build(info)
+	}
+	return b.pb.Build(local)
+}
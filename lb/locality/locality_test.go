@@ -0,0 +1,258 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package locality
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/olivere/grpc/lb/weighted"
+)
+
+// testSubConn implements balancer.SubConn for testing.
+type testSubConn struct {
+	balancer.SubConn // unimplemented methods panic
+
+	name string
+}
+
+func TestZone(t *testing.T) {
+	if want, have := "", Zone(resolver.Address{Addr: "127.0.0.1:1000"}); want != have {
+		t.Errorf("Zone without zone: want %q, have %q", want, have)
+	}
+	if want, have := "us-east-1a", Zone(SetZone(resolver.Address{Addr: "127.0.0.1:1000"}, "us-east-1a")); want != have {
+		t.Errorf("Zone: want %q, have %q", want, have)
+	}
+}
+
+// testAddrs are the addresses of the resolver in the tests: three in
+// zone a, and two in zone b.
+var testAddrs = []resolver.Address{
+	SetZone(resolver.Address{Addr: "10.0.0.1:9000"}, "a"),
+	SetZone(resolver.Address{Addr: "10.0.0.2:9000"}, "a"),
+	SetZone(resolver.Address{Addr: "10.0.0.3:9000"}, "a"),
+	SetZone(resolver.Address{Addr: "10.0.1.1:9000"}, "b"),
+	SetZone(resolver.Address{Addr: "10.0.1.2:9000"}, "b"),
+}
+
+// picked returns the sorted names of the SubConns picked by p
+// in n picks.
+func picked(t *testing.T, p balancer.Picker, n int) string {
+	t.Helper()
+	seen := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		res, err := p.Pick(balancer.PickInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[res.SubConn.(*testSubConn).name] = true
+	}
+	var names []string
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprint(names)
+}
+
+// buildInfo returns the PickerBuildInfo with the given ready addresses.
+func buildInfo(addrs ...resolver.Address) base.PickerBuildInfo {
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for _, addr := range addrs {
+		info.ReadySCs[&testSubConn{name: addr.Addr}] = base.SubConnInfo{Address: addr}
+	}
+	return info
+}
+
+func TestPickerBuilder(t *testing.T) {
+	pb := newPickerBuilder(weighted.NewPickerBuilder())
+	threshold := 60.0
+	pb.update(&config{Zone: "a", Threshold: &threshold}, testAddrs)
+
+	tests := []struct {
+		Ready []resolver.Address
+		Want  string
+	}{
+		// All addresses in zone a are ready
+		{testAddrs, "[10.0.0.1:9000 10.0.0.2:9000 10.0.0.3:9000]"},
+		// 2 of 3 addresses in zone a are ready, i.e. more than 60%
+		{testAddrs[1:], "[10.0.0.2:9000 10.0.0.3:9000]"},
+		// 1 of 3 addresses in zone a is ready, i.e. less than 60%
+		{testAddrs[2:], "[10.0.0.3:9000 10.0.1.1:9000 10.0.1.2:9000]"},
+		// No address in zone a is ready
+		{testAddrs[3:], "[10.0.1.1:9000 10.0.1.2:9000]"},
+		// Back to normal
+		{testAddrs[:4], "[10.0.0.1:9000 10.0.0.2:9000 10.0.0.3:9000]"},
+	}
+	for i, tt := range tests {
+		p := pb.Build(buildInfo(tt.Ready...))
+		if want, have := tt.Want, picked(t, p, 20); want != have {
+			t.Errorf("#%d: want %s, have %s", i, want, have)
+		}
+	}
+}
+
+func TestPickerBuilderWithWeights(t *testing.T) {
+	addrs := []resolver.Address{
+		weighted.SetWeight(SetZone(resolver.Address{Addr: "10.0.0.1:9000"}, "a"), 3),
+		SetZone(resolver.Address{Addr: "10.0.0.2:9000"}, "a"),
+		SetZone(resolver.Address{Addr: "10.0.1.1:9000"}, "b"),
+	}
+	pb := newPickerBuilder(weighted.NewPickerBuilder())
+	pb.update(&config{Zone: "a"}, addrs)
+
+	// 3 of 4 capacity is healthy
+	p := pb.Build(buildInfo(addrs[0], addrs[2]))
+	if want, have := "[10.0.0.1:9000]", picked(t, p, 20); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+	// 1 of 4 capacity is healthy
+	p = pb.Build(buildInfo(addrs[1], addrs[2]))
+	if want, have := "[10.0.0.2:9000 10.0.1.1:9000]", picked(t, p, 20); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+}
+
+func TestPickerBuilderWithRemovedAddresses(t *testing.T) {
+	now := time.Now()
+	pb := newPickerBuilder(weighted.NewPickerBuilder())
+	pb.now = func() time.Time { return now }
+	threshold := 60.0
+	cfg := &config{Zone: "a", Threshold: &threshold}
+	pb.update(cfg, testAddrs)
+
+	// The resolver removes 2 of 3 addresses in zone a as they are critical
+	pb.update(cfg, testAddrs[2:])
+	p := pb.Build(buildInfo(testAddrs[2:]...))
+	if want, have := "[10.0.0.3:9000 10.0.1.1:9000 10.0.1.2:9000]", picked(t, p, 20); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+
+	// One address recovers
+	pb.update(cfg, testAddrs[1:])
+	p = pb.Build(buildInfo(testAddrs[1:]...))
+	if want, have := "[10.0.0.2:9000 10.0.0.3:9000]", picked(t, p, 20); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+
+	// Removed addresses are forgotten after a while, e.g. after scaling down
+	now = now.Add(defaultForgetAfter)
+	pb.update(cfg, testAddrs[2:])
+	now = now.Add(defaultForgetAfter / 2)
+	p = pb.Build(buildInfo(testAddrs[2:]...))
+	if want, have := "[10.0.0.3:9000 10.0.1.1:9000 10.0.1.2:9000]", picked(t, p, 20); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+	now = now.Add(defaultForgetAfter / 2)
+	p = pb.Build(buildInfo(testAddrs[2:]...))
+	if want, have := "[10.0.0.3:9000]", picked(t, p, 20); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+}
+
+func TestPickerBuilderWithForgetAfter(t *testing.T) {
+	now := time.Now()
+	pb := newPickerBuilder(weighted.NewPickerBuilder())
+	pb.now = func() time.Time { return now }
+	cfg, err := (&builder{}).ParseConfig(json.RawMessage(`{"zone":"a","forget_after":"1m"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb.update(cfg, testAddrs)
+
+	// Zone a is scaled down from 3 addresses to 1
+	pb.update(cfg, testAddrs[2:])
+	p := pb.Build(buildInfo(testAddrs[2:]...))
+	if want, have := "[10.0.0.3:9000 10.0.1.1:9000 10.0.1.2:9000]", picked(t, p, 20); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+
+	// The balancer returns to zone a after forget_after, not the default
+	now = now.Add(time.Minute)
+	p = pb.Build(buildInfo(testAddrs[2:]...))
+	if want, have := "[10.0.0.3:9000]", picked(t, p, 20); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+}
+
+func TestPickerBuilderWithCapacity(t *testing.T) {
+	pb := newPickerBuilder(weighted.NewPickerBuilder())
+
+	// The resolver only ever returns 2 addresses in zone a, but 4 are expected
+	pb.update(&config{Zone: "a", Capacity: 4}, testAddrs[1:])
+	p := pb.Build(buildInfo(testAddrs[1:]...))
+	if want, have := "[10.0.0.2:9000 10.0.0.3:9000]", picked(t, p, 20); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+	pb.update(&config{Zone: "a", Capacity: 4}, testAddrs[2:])
+	p = pb.Build(buildInfo(testAddrs[2:]...))
+	if want, have := "[10.0.0.3:9000 10.0.1.1:9000 10.0.1.2:9000]", picked(t, p, 20); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+}
+
+func TestPickerBuilderWithoutZone(t *testing.T) {
+	pb := newPickerBuilder(weighted.NewPickerBuilder())
+	pb.update(&config{}, testAddrs)
+	p := pb.Build(buildInfo(testAddrs...))
+	if want, have := "[10.0.0.1:9000 10.0.0.2:9000 10.0.0.3:9000 10.0.1.1:9000 10.0.1.2:9000]", picked(t, p, 20); want != have {
+		t.Fatalf("want %s, have %s", want, have)
+	}
+}
+
+func TestPickerWithoutSubConns(t *testing.T) {
+	pb := newPickerBuilder(weighted.NewPickerBuilder())
+	p := pb.Build(base.PickerBuildInfo{})
+	if _, err := p.Pick(balancer.PickInfo{}); err != balancer.ErrNoSubConnAvailable {
+		t.Fatalf("Pick: want %v, have %v", balancer.ErrNoSubConnAvailable, err)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		JSON string
+		Err  bool
+	}{
+		{`{}`, false},
+		{`{"zone":"us-east-1a"}`, false},
+		{`{"zone":"us-east-1a","threshold":0}`, false},
+		{`{"zone":"us-east-1a","threshold":100}`, false},
+		{`{"zone":"us-east-1a","threshold":101}`, true},
+		{`{"zone":"us-east-1a","capacity":6}`, false},
+		{`{"zone":"us-east-1a","capacity":-1}`, true},
+		{`{"zone":"us-east-1a","forget_after":"90s"}`, false},
+		{`{"zone":"us-east-1a","forget_after":"0s"}`, true},
+		{`{"zone":"us-east-1a","forget_after":"10"}`, true},
+		{`{"zone":1}`, true},
+	}
+	for i, tt := range tests {
+		cfg, err := (&builder{}).ParseConfig(json.RawMessage(tt.JSON))
+		if tt.Err {
+			if err == nil {
+				t.Errorf("#%d: want error, have nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if _, ok := cfg.(*config); !ok {
+			t.Fatalf("#%d: want *config, have %T", i, cfg)
+		}
+	}
+}
+
+func TestBalancerIsRegistered(t *testing.T) {
+	if balancer.Get(Name) == nil {
+		t.Fatalf("want balancer %q to be registered", Name)
+	}
+}
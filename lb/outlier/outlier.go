@@ -0,0 +1,471 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+// Package outlier implements outlier detection for gRPC balancers.
+//
+// The resolvers only learn about bad backends from Consul or from health
+// checks. Outlier detection uses the results of the actual RPCs instead:
+// It tracks the failures and latency of every address, ejects addresses
+// that misbehave for a period of time, and re-admits them afterwards,
+// like the outlier detection of Envoy. Every time an address is ejected
+// again, the ejection time doubles.
+//
+// The balancer registered as "outlier_detection" combines outlier
+// detection with the smooth weighted round-robin balancer of package
+// weighted. It works with any resolver. Select it via the service
+// config, e.g.:
+//
+//	grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"outlier_detection":{}}]}`)
+//
+// Use NewBalancerBuilder to wrap other pickers or to change the settings,
+// and register the result with balancer.Register under a different name.
+package outlier
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+
+	"github.com/olivere/grpc/lb/weighted"
+)
+
+// Name is the name the balancer is registered with in gRPC.
+const Name = "outlier_detection"
+
+var (
+	defaultInterval            = 10 * time.Second
+	defaultMinRequests         = 20
+	defaultFailurePercentage   = 50.0
+	defaultConsecutiveFailures = 5
+	defaultBaseEjectionTime    = 30 * time.Second
+	defaultMaxEjectionTime     = 5 * time.Minute
+	defaultMaxEjectionPercent  = 10.0
+	defaultFailureCodes        = []codes.Code{
+		codes.Unknown,
+		codes.DeadlineExceeded,
+		codes.Internal,
+		codes.Unavailable,
+		codes.DataLoss,
+	}
+)
+
+func init() {
+	balancer.Register(NewBalancerBuilder(Name, weighted.NewPickerBuilder()))
+}
+
+// Option configures the outlier detection.
+type Option func(*detector)
+
+// SetInterval specifies the interval in which the failure percentage and
+// the latency of an address are evaluated. It defaults to 10 seconds.
+func SetInterval(d time.Duration) Option {
+	return func(det *detector) {
+		det.interval = d
+	}
+}
+
+// SetMinRequests specifies the minimum number of RPCs an address must
+// have served in an interval for its failure percentage and latency to
+// be evaluated. It defaults to 20.
+func SetMinRequests(n int) Option {
+	return func(det *detector) {
+		det.minRequests = n
+	}
+}
+
+// SetFailurePercentage specifies the percentage of failed RPCs in an
+// interval, e.g. 50 for 50%, at which an address is ejected. Use 0 to
+// disable it. It defaults to 50%.
+func SetFailurePercentage(percent float64) Option {
+	return func(det *detector) {
+		det.failurePercentage = percent
+	}
+}
+
+// SetConsecutiveFailures specifies the number of consecutive failed RPCs
+// after which an address is ejected right away. Use 0 to disable it.
+// It defaults to 5.
+func SetConsecutiveFailures(n int) Option {
+	return func(det *detector) {
+		det.consecutiveFailures = n
+	}
+}
+
+// SetMaxLatency specifies the average latency of the RPCs in an interval
+// at which an address is ejected. The latency is measured from picking
+// the address until the RPC is done, so it is only meaningful for unary
+// RPCs. It is disabled by default.
+func SetMaxLatency(d time.Duration) Option {
+	return func(det *detector) {
+		det.maxLatency = d
+	}
+}
+
+// SetEjectionTime specifies how long an address is ejected. The ejection
+// time starts at base and doubles every time the address is ejected again,
+// up to max. Every interval in which the address isn't ejected again
+// halves it. It defaults to 30 seconds and 5 minutes respectively.
+func SetEjectionTime(base, max time.Duration) Option {
+	return func(det *detector) {
+		det.baseEjectionTime = base
+		det.maxEjectionTime = max
+	}
+}
+
+// SetMaxEjectionPercent specifies the maximum percentage of addresses
+// that can be ejected at the same time. At least one address can be
+// ejected regardless of the percentage, but never all of them. It
+// defaults to 10%.
+func SetMaxEjectionPercent(percent float64) Option {
+	return func(det *detector) {
+		det.maxEjectionPercent = percent
+	}
+}
+
+// SetFailureCodes specifies the gRPC status codes that count as failures.
+// Other errors, e.g. NotFound or Canceled, are caused by the client or the
+// application and don't say anything about the health of an address. It
+// defaults to Unknown, DeadlineExceeded, Internal, Unavailable and DataLoss.
+func SetFailureCodes(failureCodes ...codes.Code) Option {
+	return func(det *detector) {
+		det.failureCodes = failureCodes
+	}
+}
+
+// NewBalancerBuilder returns a balancer.Builder with the given name that
+// picks addresses with the picker created by pb, except for the addresses
+// ejected by outlier detection. Every balancer created by the builder,
+// i.e. every gRPC client connection, tracks its addresses separately.
+func NewBalancerBuilder(name string, pb base.PickerBuilder, options ...Option) balancer.Builder {
+	return &builder{name: name, pb: pb, options: options}
+}
+
+// builder creates balancers with outlier detection.
+type builder struct {
+	name    string
+	pb      base.PickerBuilder
+	options []Option
+}
+
+// Name returns the name of the balancer.
+func (b *builder) Name() string {
+	return b.name
+}
+
+// Build creates a new balancer for cc.
+func (b *builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	d := newDetector(b.options...)
+	pb := &pickerBuilder{pb: b.pb, d: d}
+	return &outlierBalancer{
+		Balancer: weighted.NewBalancerBuilder(b.name, pb, base.Config{}).Build(cc, opts),
+		d:        d,
+	}
+}
+
+// outlierBalancer passes the addresses from the resolver to the detector,
+// so the statistics of an address survive while its SubConn reconnects.
+type outlierBalancer struct {
+	balancer.Balancer
+	d *detector
+}
+
+// UpdateClientConnState is called by gRPC when the state of the
+// ClientConn changes.
+func (b *outlierBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	b.d.update(s.ResolverState.Addresses)
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+// pickerBuilder wraps the pickers of a base.PickerBuilder with
+// outlier detection.
+type pickerBuilder struct {
+	pb base.PickerBuilder
+	d  *detector
+}
+
+// Build creates a new picker.
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	addrs := make(map[balancer.SubConn]string, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		addrs[sc] = sci.Address.Addr
+	}
+	return &picker{pb: b.pb, d: b.d, info: info, addrs: addrs}
+}
+
+// picker picks from the addresses that are not ejected. It rebuilds the
+// wrapped picker whenever addresses are ejected or re-admitted.
+type picker struct {
+	pb    base.PickerBuilder
+	d     *detector
+	info  base.PickerBuildInfo
+	addrs map[balancer.SubConn]string
+
+	mu         sync.Mutex
+	generation uint64
+	child      balancer.Picker
+}
+
+// Pick returns the SubConn to use for the next RPC.
+func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	generation := p.d.refresh()
+
+	p.mu.Lock()
+	if p.child == nil || p.generation != generation {
+		p.child = p.build()
+		p.generation = generation
+	}
+	child := p.child
+	p.mu.Unlock()
+
+	res, err := child.Pick(info)
+	if err != nil {
+		return res, err
+	}
+	addr, start, done := p.addrs[res.SubConn], time.Now(), res.Done
+	res.Done = func(di balancer.DoneInfo) {
+		if done != nil {
+			done(di)
+		}
+		p.d.record(addr, di.Err, time.Since(start))
+	}
+	return res, nil
+}
+
+// build creates the wrapped picker from the addresses that are not
+// ejected. If all addresses are ejected, it uses all of them.
+func (p *picker) build() balancer.Picker {
+	ready := make(map[balancer.SubConn]base.SubConnInfo, len(p.info.ReadySCs))
+	for sc, sci := range p.info.ReadySCs {
+		if !p.d.ejected(p.addrs[sc]) {
+			ready[sc] = sci
+		}
+	}
+	if len(ready) == 0 {
+		return p.pb.Build(p.info)
+	}
+	return p.pb.Build(base.PickerBuildInfo{ReadySCs: ready})
+}
+
+// detector tracks the RPCs of the addresses of a balancer and decides
+// which addresses to eject.
+type detector struct {
+	interval            time.Duration
+	minRequests         int
+	failurePercentage   float64
+	consecutiveFailures int
+	maxLatency          time.Duration
+	baseEjectionTime    time.Duration
+	maxEjectionTime     time.Duration
+	maxEjectionPercent  float64
+	failureCodes        []codes.Code
+	now                 func() time.Time
+
+	mu         sync.Mutex
+	stats      map[string]*stats
+	numEjected int
+	generation uint64 // changes when addresses are ejected or re-admitted
+}
+
+// stats are the statistics of an address.
+type stats struct {
+	start        time.Time // start of the current interval
+	requests     int
+	failures     int
+	latency      time.Duration
+	consecutive  int
+	ejections    int // multiplier for the ejection time
+	ejectedUntil time.Time
+}
+
+// reset starts a new interval.
+func (s *stats) reset(now time.Time) {
+	s.start = now
+	s.requests = 0
+	s.failures = 0
+	s.latency = 0
+	s.consecutive = 0
+}
+
+// newDetector creates a new detector.
+func newDetector(options ...Option) *detector {
+	d := &detector{
+		interval:            defaultInterval,
+		minRequests:         defaultMinRequests,
+		failurePercentage:   defaultFailurePercentage,
+		consecutiveFailures: defaultConsecutiveFailures,
+		baseEjectionTime:    defaultBaseEjectionTime,
+		maxEjectionTime:     defaultMaxEjectionTime,
+		maxEjectionPercent:  defaultMaxEjectionPercent,
+		failureCodes:        defaultFailureCodes,
+		now:                 time.Now,
+		stats:               make(map[string]*stats),
+	}
+	for _, option := range options {
+		option(d)
+	}
+	return d
+}
+
+// update starts tracking the addresses from the resolver and stops
+// tracking the addresses the resolver has removed. Addresses whose
+// SubConn is not ready keep their statistics, so an ejected address
+// stays ejected when it reconnects.
+func (d *detector) update(addrs []resolver.Address) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	current := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		current[addr.Addr] = true
+		if _, found := d.stats[addr.Addr]; !found {
+			d.stats[addr.Addr] = &stats{start: now}
+		}
+	}
+	for addr, s := range d.stats {
+		if !current[addr] {
+			if !s.ejectedUntil.IsZero() {
+				d.numEjected--
+			}
+			delete(d.stats, addr)
+		}
+	}
+}
+
+// refresh re-admits the addresses whose ejection time has passed, and
+// returns the current generation.
+func (d *detector) refresh() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.numEjected == 0 {
+		return d.generation
+	}
+	now := d.now()
+	for addr, s := range d.stats {
+		if !s.ejectedUntil.IsZero() && !now.Before(s.ejectedUntil) {
+			log.Printf("grpc/lb/outlier: re-admitting %s", addr)
+			s.ejectedUntil = time.Time{}
+			s.reset(now)
+			d.numEjected--
+			d.generation++
+		}
+	}
+	return d.generation
+}
+
+// ejected returns true if addr is currently ejected.
+func (d *detector) ejected(addr string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, found := d.stats[addr]
+	return found && !s.ejectedUntil.IsZero()
+}
+
+// record records the result of an RPC sent to addr, and ejects addr
+// if it has turned out to be an outlier.
+func (d *detector) record(addr string, err error, latency time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, found := d.stats[addr]
+	if !found || !s.ejectedUntil.IsZero() {
+		// Address is gone or RPC was sent before addr was ejected
+		return
+	}
+	now := d.now()
+	s.requests++
+	s.latency += latency
+	if d.failed(err) {
+		s.failures++
+		s.consecutive++
+	} else {
+		s.consecutive = 0
+	}
+
+	if d.consecutiveFailures > 0 && s.consecutive >= d.consecutiveFailures {
+		d.eject(addr, s, now, fmt.Sprintf("%d consecutive failures", s.consecutive))
+		return
+	}
+	if now.Sub(s.start) < d.interval {
+		return
+	}
+	if s.requests >= d.minRequests {
+		if reason := d.outlier(s); reason != "" {
+			d.eject(addr, s, now, reason)
+			return
+		}
+	}
+	if s.ejections > 0 {
+		s.ejections--
+	}
+	s.reset(now)
+}
+
+// failed returns true if err counts as a failure.
+func (d *detector) failed(err error) bool {
+	if err == nil {
+		return false
+	}
+	code := status.Code(err)
+	for _, c := range d.failureCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// outlier checks whether the failure percentage or the average latency
+// of the current interval of s exceeds the thresholds. It returns the
+// reason if it does, and an empty string otherwise.
+func (d *detector) outlier(s *stats) string {
+	if d.failurePercentage > 0 && float64(s.failures)*100 >= d.failurePercentage*float64(s.requests) {
+		return fmt.Sprintf("%d of %d RPCs failed", s.failures, s.requests)
+	}
+	if latency := s.latency / time.Duration(s.requests); d.maxLatency > 0 && latency > d.maxLatency {
+		return fmt.Sprintf("average latency of %v", latency)
+	}
+	return ""
+}
+
+// eject ejects addr for the given reason unless the maximum number of
+// ejected addresses is reached. The caller must hold d.mu.
+func (d *detector) eject(addr string, s *stats, now time.Time, reason string) {
+	defer s.reset(now)
+
+	max := int(d.maxEjectionPercent * float64(len(d.stats)) / 100)
+	if max < 1 {
+		max = 1
+	}
+	if max > len(d.stats)-1 {
+		max = len(d.stats) - 1
+	}
+	if d.numEjected >= max {
+		return
+	}
+
+	ejectionTime := d.baseEjectionTime
+	for i := 0; i < s.ejections && ejectionTime < d.maxEjectionTime; i++ {
+		ejectionTime *= 2
+	}
+	if ejectionTime > d.maxEjectionTime {
+		ejectionTime = d.maxEjectionTime
+	}
+	log.Printf("grpc/lb/outlier: ejecting %s for %v after %s", addr, ejectionTime, reason)
+	s.ejections++
+	s.ejectedUntil = now.Add(ejectionTime)
+	d.numEjected++
+	d.generation++
+}
@@ -0,0 +1,374 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package outlier
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+
+	"github.com/olivere/grpc/lb/weighted"
+)
+
+// testSubConn implements balancer.SubConn for testing.
+type testSubConn struct {
+	balancer.SubConn // unimplemented methods panic
+
+	name string
+}
+
+// testClock is a clock that only advances when told to.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// newTestDetector returns a detector that tracks the given addresses
+// and uses clock as its time source.
+func newTestDetector(clock *testClock, addrs []string, options ...Option) *detector {
+	d := newDetector(options...)
+	d.now = clock.Now
+	var resolved []resolver.Address
+	for _, addr := range addrs {
+		resolved = append(resolved, resolver.Address{Addr: addr})
+	}
+	d.update(resolved)
+	return d
+}
+
+var errUnavailable = status.Error(codes.Unavailable, "unavailable")
+
+func TestDetectorConsecutiveFailures(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	d := newTestDetector(clock, []string{"a", "b"},
+		SetConsecutiveFailures(3),
+		SetEjectionTime(10*time.Second, 25*time.Second),
+	)
+
+	d.record("a", errUnavailable, 0)
+	d.record("a", errUnavailable, 0)
+	d.record("a", nil, 0)
+	d.record("a", errUnavailable, 0)
+	d.record("a", errUnavailable, 0)
+	if d.ejected("a") {
+		t.Fatal("want a not ejected")
+	}
+	d.record("a", errUnavailable, 0)
+	if !d.ejected("a") {
+		t.Fatal("want a ejected")
+	}
+	if d.ejected("b") {
+		t.Fatal("want b not ejected")
+	}
+
+	// The ejection time doubles with every ejection, up to the maximum
+	for _, ejectionTime := range []time.Duration{10 * time.Second, 20 * time.Second, 25 * time.Second} {
+		generation := d.refresh()
+		clock.Advance(ejectionTime - time.Millisecond)
+		if want, have := generation, d.refresh(); want != have {
+			t.Fatalf("generation: want %d, have %d", want, have)
+		}
+		if !d.ejected("a") {
+			t.Fatalf("want a ejected for %v", ejectionTime)
+		}
+		clock.Advance(time.Millisecond)
+		if have := d.refresh(); have == generation {
+			t.Fatal("want generation to change on re-admission")
+		}
+		if d.ejected("a") {
+			t.Fatalf("want a re-admitted after %v", ejectionTime)
+		}
+		for i := 0; i < 3; i++ {
+			d.record("a", errUnavailable, 0)
+		}
+	}
+}
+
+func TestDetectorFailurePercentage(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	d := newTestDetector(clock, []string{"a", "b"},
+		SetInterval(10*time.Second),
+		SetMinRequests(4),
+		SetFailurePercentage(50),
+		SetConsecutiveFailures(0),
+	)
+
+	// Too few requests
+	d.record("a", errUnavailable, 0)
+	d.record("a", errUnavailable, 0)
+	clock.Advance(10 * time.Second)
+	d.record("a", errUnavailable, 0)
+	if d.ejected("a") {
+		t.Fatal("want a not ejected")
+	}
+
+	// Errors that don't count as failures
+	for i := 0; i < 4; i++ {
+		d.record("a", status.Error(codes.NotFound, "not found"), 0)
+		d.record("a", status.Error(codes.Canceled, "canceled"), 0)
+	}
+	clock.Advance(10 * time.Second)
+	d.record("a", nil, 0)
+	if d.ejected("a") {
+		t.Fatal("want a not ejected")
+	}
+
+	// Errors without a status count as Unknown
+	for i := 0; i < 4; i++ {
+		d.record("a", errors.New("unknown"), 0)
+	}
+	d.record("a", nil, 0)
+	clock.Advance(10 * time.Second)
+	d.record("a", nil, 0)
+	if !d.ejected("a") {
+		t.Fatal("want a ejected")
+	}
+
+	for i := 0; i < 3; i++ {
+		d.record("b", nil, 0)
+		d.record("b", status.Error(codes.Canceled, "canceled"), 0)
+	}
+	clock.Advance(10 * time.Second)
+	d.record("b", errUnavailable, 0)
+	if d.ejected("b") {
+		t.Fatal("want b not ejected")
+	}
+}
+
+func TestDetectorMaxLatency(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	d := newTestDetector(clock, []string{"a", "b"},
+		SetInterval(10*time.Second),
+		SetMinRequests(2),
+		SetMaxLatency(100*time.Millisecond),
+	)
+
+	d.record("b", nil, 50*time.Millisecond)
+	d.record("a", nil, 50*time.Millisecond)
+	clock.Advance(10 * time.Second)
+	d.record("b", nil, 150*time.Millisecond)
+	d.record("a", nil, 250*time.Millisecond)
+	if d.ejected("b") {
+		t.Fatal("want b not ejected")
+	}
+	if !d.ejected("a") {
+		t.Fatal("want a ejected")
+	}
+}
+
+func TestDetectorMaxEjectionPercent(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	d := newTestDetector(clock, []string{"a", "b", "c", "d", "e"},
+		SetConsecutiveFailures(1),
+		SetMaxEjectionPercent(40),
+	)
+	for _, addr := range []string{"a", "b", "c", "d", "e"} {
+		d.record(addr, errUnavailable, 0)
+	}
+	var ejected []string
+	for _, addr := range []string{"a", "b", "c", "d", "e"} {
+		if d.ejected(addr) {
+			ejected = append(ejected, addr)
+		}
+	}
+	if want, have := 2, len(ejected); want != have {
+		t.Fatalf("want %d ejected addresses, have %d: %v", want, have, ejected)
+	}
+
+	// A single address is never ejected
+	d = newTestDetector(clock, []string{"a"}, SetConsecutiveFailures(1))
+	d.record("a", errUnavailable, 0)
+	if d.ejected("a") {
+		t.Fatal("want a not ejected")
+	}
+}
+
+func TestPicker(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	sc1 := &testSubConn{name: "sc1"}
+	sc2 := &testSubConn{name: "sc2"}
+	pb := &pickerBuilder{
+		pb: weighted.NewPickerBuilder(),
+		d:  newDetector(SetConsecutiveFailures(2), SetMaxEjectionPercent(50)),
+	}
+	pb.d.now = clock.Now
+	pb.d.update([]resolver.Address{{Addr: "127.0.0.1:1000"}, {Addr: "127.0.0.1:1001"}})
+	p := pb.Build(base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			sc1: {Address: resolver.Address{Addr: "127.0.0.1:1000"}},
+			sc2: {Address: resolver.Address{Addr: "127.0.0.1:1001"}},
+		},
+	})
+
+	pick := func(err error) string {
+		res, perr := p.Pick(balancer.PickInfo{})
+		if perr != nil {
+			t.Fatal(perr)
+		}
+		name := res.SubConn.(*testSubConn).name
+		if name == "sc1" {
+			res.Done(balancer.DoneInfo{Err: err})
+		} else {
+			res.Done(balancer.DoneInfo{})
+		}
+		return name
+	}
+
+	// sc1 fails every RPC and gets ejected
+	picks := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		picks[pick(errUnavailable)]++
+	}
+	if want, have := 2, picks["sc1"]; want != have {
+		t.Fatalf("picks of sc1: want %d, have %d", want, have)
+	}
+	for i := 0; i < 10; i++ {
+		if want, have := "sc2", pick(nil); want != have {
+			t.Fatalf("want %s, have %s", want, have)
+		}
+	}
+
+	// sc1 is re-admitted after the ejection time
+	clock.Advance(defaultBaseEjectionTime)
+	picks = make(map[string]int)
+	for i := 0; i < 10; i++ {
+		picks[pick(nil)]++
+	}
+	if want, have := 5, picks["sc1"]; want != have {
+		t.Fatalf("picks of sc1: want %d, have %d", want, have)
+	}
+}
+
+func TestPickerKeepsEjectionWhileReconnecting(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	sc1 := &testSubConn{name: "sc1"}
+	sc2 := &testSubConn{name: "sc2"}
+	sc3 := &testSubConn{name: "sc3"}
+	addrs := []resolver.Address{{Addr: "127.0.0.1:1000"}, {Addr: "127.0.0.1:1001"}, {Addr: "127.0.0.1:1002"}}
+	pb := &pickerBuilder{
+		pb: weighted.NewPickerBuilder(),
+		d: newDetector(
+			SetConsecutiveFailures(1),
+			SetMaxEjectionPercent(34),
+			SetEjectionTime(10*time.Second, time.Minute),
+		),
+	}
+	pb.d.now = clock.Now
+	pb.d.update(addrs)
+	all := base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			sc1: {Address: addrs[0]},
+			sc2: {Address: addrs[1]},
+			sc3: {Address: addrs[2]},
+		},
+	}
+	// Without sc1, e.g. while it is in TRANSIENT_FAILURE
+	others := base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			sc2: {Address: addrs[1]},
+			sc3: {Address: addrs[2]},
+		},
+	}
+
+	// failUntilEjected sends failing RPCs to sc1 until it is ejected
+	failUntilEjected := func(p balancer.Picker) {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			res, err := p.Pick(balancer.PickInfo{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.SubConn == sc1 {
+				res.Done(balancer.DoneInfo{Err: errUnavailable})
+				return
+			}
+			res.Done(balancer.DoneInfo{})
+		}
+		t.Fatal("want a pick of sc1")
+	}
+	// picksOf returns the number of picks of sc in 10 picks
+	picksOf := func(p balancer.Picker, sc balancer.SubConn) int {
+		var n int
+		for i := 0; i < 10; i++ {
+			res, err := p.Pick(balancer.PickInfo{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.SubConn == sc {
+				n++
+			}
+			res.Done(balancer.DoneInfo{})
+		}
+		return n
+	}
+
+	failUntilEjected(pb.Build(all))
+	if !pb.d.ejected(addrs[0].Addr) {
+		t.Fatal("want sc1 ejected")
+	}
+
+	// sc1 goes through TRANSIENT_FAILURE and reconnects: It stays ejected
+	pb.Build(others)
+	clock.Advance(5 * time.Second)
+	if want, have := 0, picksOf(pb.Build(all), sc1); want != have {
+		t.Fatalf("picks of sc1: want %d, have %d", want, have)
+	}
+
+	// Another address can't be ejected, as sc1 still counts as ejected
+	pb.d.record(addrs[1].Addr, errUnavailable, 0)
+	if pb.d.ejected(addrs[1].Addr) {
+		t.Fatal("want sc2 not ejected")
+	}
+
+	// sc1 is re-admitted after 10s, and ejected for 20s the next time
+	clock.Advance(5 * time.Second)
+	p := pb.Build(all)
+	if have := picksOf(p, sc1); have == 0 {
+		t.Fatal("want picks of sc1 after re-admission")
+	}
+	failUntilEjected(p)
+	pb.Build(others)
+	clock.Advance(15 * time.Second)
+	if want, have := 0, picksOf(pb.Build(all), sc1); want != have {
+		t.Fatalf("picks of sc1 after 15s: want %d, have %d", want, have)
+	}
+	clock.Advance(5 * time.Second)
+	if have := picksOf(pb.Build(all), sc1); have == 0 {
+		t.Fatal("want picks of sc1 after 20s")
+	}
+
+	// The statistics are dropped when the resolver removes the address
+	pb.d.update(addrs[1:])
+	if _, found := pb.d.stats[addrs[0].Addr]; found {
+		t.Fatal("want statistics of sc1 to be dropped")
+	}
+}
+
+func TestPickerWithoutSubConns(t *testing.T) {
+	pb := &pickerBuilder{pb: weighted.NewPickerBuilder(), d: newDetector()}
+	p := pb.Build(base.PickerBuildInfo{})
+	if _, err := p.Pick(balancer.PickInfo{}); err != balancer.ErrNoSubConnAvailable {
+		t.Fatalf("Pick: want %v, have %v", balancer.ErrNoSubConnAvailable, err)
+	}
+}
+
+func TestBalancerIsRegistered(t *testing.T) {
+	if balancer.Get(Name) == nil {
+		t.Fatalf("want balancer %q to be registered", Name)
+	}
+}
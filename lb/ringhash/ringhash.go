@@ -0,0 +1,253 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+// Package ringhash implements a consistent hashing balancer for gRPC.
+//
+// The balancer places every ready address on a hash ring, and sends each
+// RPC to the address that follows the hash of its key on the ring. RPCs
+// with the same key go to the same address, e.g. to the same shard of a
+// cache. When addresses are added or removed, only the keys of the
+// affected addresses move to another address.
+//
+// The key of an RPC is the value passed to WithHashKey, or else the value
+// of the metadata header specified in the service config. RPCs without a
+// key are sent to a random address. Weights attached with weighted.SetWeight
+// are respected, i.e. an address with weight 2 gets twice the keys.
+//
+// Select the balancer via the service config, e.g.:
+//
+//	grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"ring_hash":{"header":"x-user-id"}}]}`)
+//
+// The config has these settings:
+//
+//   - header: the metadata header to take the key from
+//   - replicas: the number of entries on the ring per unit of weight
+//     (default: 100); more entries spread the keys more evenly
+//
+// The ring has at most 65536 entries. If the weights and replicas of the
+// addresses add up to more, e.g. with the weights of DNS SRV records, the
+// number of entries of every address is scaled down proportionally.
+package ringhash
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/serviceconfig"
+
+	"github.com/olivere/grpc/lb/weighted"
+)
+
+// Name is the name the balancer is registered with in gRPC.
+const Name = "ring_hash"
+
+var (
+	defaultReplicas = 100
+	maxRingSize     = 1 << 16
+)
+
+func init() {
+	balancer.Register(&builder{})
+}
+
+// hashKey is the key for the hash key in the context.
+type hashKey struct{}
+
+// WithHashKey returns a copy of ctx with the given key for the balancer.
+// Use it for RPCs that must go to the same address. It takes precedence
+// over the header specified in the service config.
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKey{}, key)
+}
+
+// HashKey returns the key passed to WithHashKey, and false if there is none.
+func HashKey(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(hashKey{}).(string)
+	return key, ok
+}
+
+// config is the configuration of the balancer in the service config.
+type config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	Header   string `json:"header,omitempty"`
+	Replicas int    `json:"replicas,omitempty"`
+}
+
+// builder creates balancers and parses their configuration.
+type builder struct{}
+
+// Name returns the name of the balancer.
+func (*builder) Name() string {
+	return Name
+}
+
+// Build creates a new balancer for cc.
+func (*builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &pickerBuilder{replicas: defaultReplicas}
+	return &ringHashBalancer{
+		Balancer: weighted.NewBalancerBuilder(Name, pb, base.Config{}).Build(cc, opts),
+		pb:       pb,
+	}
+}
+
+// ParseConfig parses the configuration of the balancer in the service config.
+func (*builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	cfg := &config{}
+	if err := json.Unmarshal(js, cfg); err != nil {
+		return nil, fmt.Errorf("grpc/lb/ringhash: unable to parse config: %v", err)
+	}
+	if cfg.Replicas < 0 || cfg.Replicas > maxRingSize {
+		return nil, fmt.Errorf("grpc/lb/ringhash: replicas must be between 0 and %d, have %d", maxRingSize, cfg.Replicas)
+	}
+	return cfg, nil
+}
+
+// ringHashBalancer passes the configuration from the service config
+// to the picker builder.
+type ringHashBalancer struct {
+	balancer.Balancer
+	pb *pickerBuilder
+}
+
+// UpdateClientConnState is called by gRPC when the state of the
+// ClientConn changes.
+func (b *ringHashBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if cfg, ok := s.BalancerConfig.(*config); ok {
+		b.pb.setConfig(cfg)
+	}
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+// pickerBuilder creates pickers from the ready SubConns.
+type pickerBuilder struct {
+	mu       sync.Mutex
+	header   string
+	replicas int
+}
+
+// setConfig applies the configuration from the service config.
+func (b *pickerBuilder) setConfig(cfg *config) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.header = strings.ToLower(cfg.Header)
+	b.replicas = defaultReplicas
+	if cfg.Replicas > 0 {
+		b.replicas = cfg.Replicas
+	}
+}
+
+// Build creates a new picker.
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	b.mu.Lock()
+	header, replicas := b.header, b.replicas
+	b.mu.Unlock()
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+
+	// The entries of an address only depend on the address and its
+	// weight, so adding or removing other addresses doesn't move them,
+	// unless the ring would exceed its maximum size
+	var total float64
+	for _, sci := range info.ReadySCs {
+		total += float64(weighted.Weight(sci.Address)) * float64(replicas)
+	}
+	scale := 1.0
+	if total > float64(maxRingSize) {
+		scale = float64(maxRingSize) / total
+	}
+
+	p := &picker{header: header}
+	for sc, sci := range info.ReadySCs {
+		n := int(float64(weighted.Weight(sci.Address)) * float64(replicas) * scale)
+		if n < 1 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			p.ring = append(p.ring, entry{
+				hash: hash(sci.Address.Addr + "_" + strconv.Itoa(i)),
+				sc:   sc,
+			})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+	return p
+}
+
+// entry is an entry on the hash ring.
+type entry struct {
+	hash uint64
+	sc   balancer.SubConn
+}
+
+// picker picks SubConns from a hash ring.
+type picker struct {
+	header string
+	ring   []entry // sorted by hash
+}
+
+// Pick returns the SubConn to use for the next RPC.
+func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	key, ok := p.key(info.Ctx)
+	if !ok {
+		return balancer.PickResult{SubConn: p.ring[rand.Intn(len(p.ring))].sc}, nil
+	}
+	h := hash(key)
+	i := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= h
+	})
+	if i == len(p.ring) {
+		i = 0
+	}
+	return balancer.PickResult{SubConn: p.ring[i].sc}, nil
+}
+
+// key returns the hash key of an RPC.
+func (p *picker) key(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	if key, ok := HashKey(ctx); ok {
+		return key, true
+	}
+	if p.header == "" {
+		return "", false
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	values := md.Get(p.header)
+	if len(values) == 0 {
+		return "", false
+	}
+	return strings.Join(values, ","), true
+}
+
+// hash returns the hash of s. It mixes the bits of FNV-1a with the
+// finalizer of MurmurHash3, so similar strings are spread on the ring.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
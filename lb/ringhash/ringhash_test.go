@@ -0,0 +1,291 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package ringhash
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+
+	"github.com/olivere/grpc/lb/weighted"
+)
+
+// testSubConn implements balancer.SubConn for testing.
+type testSubConn struct {
+	balancer.SubConn // unimplemented methods panic
+
+	name string
+}
+
+// buildPicker builds a picker for the given SubConns with the given
+// weights, using the given header.
+func buildPicker(header string, scs []*testSubConn, weights ...uint32) balancer.Picker {
+	pb := &pickerBuilder{}
+	pb.setConfig(&config{Header: header})
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for i, sc := range scs {
+		addr := resolver.Address{Addr: sc.name}
+		if i < len(weights) {
+			addr = weighted.SetWeight(addr, weights[i])
+		}
+		info.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+	}
+	return pb.Build(info)
+}
+
+// pick picks a SubConn from p for ctx and returns its name.
+func pick(t *testing.T, p balancer.Picker, ctx context.Context) string {
+	t.Helper()
+	res, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.SubConn.(*testSubConn).name
+}
+
+func TestPickByHashKey(t *testing.T) {
+	scs := []*testSubConn{{name: "10.0.0.1:9000"}, {name: "10.0.0.2:9000"}, {name: "10.0.0.3:9000"}}
+	p := buildPicker("", scs)
+
+	picks := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		ctx := WithHashKey(context.Background(), fmt.Sprintf("user-%d", i))
+		name := pick(t, p, ctx)
+		for j := 0; j < 3; j++ {
+			if want, have := name, pick(t, p, ctx); want != have {
+				t.Fatalf("user-%d: want %s, have %s", i, want, have)
+			}
+		}
+		picks[name]++
+	}
+	if want, have := 3, len(picks); want != have {
+		t.Fatalf("want keys on %d SubConns, have %d: %v", want, have, picks)
+	}
+}
+
+func TestPickByHeader(t *testing.T) {
+	scs := []*testSubConn{{name: "10.0.0.1:9000"}, {name: "10.0.0.2:9000"}, {name: "10.0.0.3:9000"}}
+	p := buildPicker("X-User-ID", scs)
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user-id", key)
+		if want, have := pick(t, p, WithHashKey(context.Background(), key)), pick(t, p, ctx); want != have {
+			t.Fatalf("%s: want %s, have %s", key, want, have)
+		}
+	}
+
+	// WithHashKey takes precedence
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user-id", "user-1")
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		if want, have := pick(t, p, WithHashKey(context.Background(), key)), pick(t, p, WithHashKey(ctx, key)); want != have {
+			t.Fatalf("%s: want %s, have %s", key, want, have)
+		}
+	}
+}
+
+func TestPickWithoutKey(t *testing.T) {
+	scs := []*testSubConn{{name: "10.0.0.1:9000"}, {name: "10.0.0.2:9000"}}
+	p := buildPicker("x-user-id", scs)
+
+	picks := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		picks[pick(t, p, context.Background())]++
+	}
+	if want, have := 2, len(picks); want != have {
+		t.Fatalf("want RPCs on %d SubConns, have %d: %v", want, have, picks)
+	}
+}
+
+func TestMinimalRemapping(t *testing.T) {
+	scs := []*testSubConn{{name: "10.0.0.1:9000"}, {name: "10.0.0.2:9000"}, {name: "10.0.0.3:9000"}, {name: "10.0.0.4:9000"}}
+	before := buildPicker("", scs)
+	after := buildPicker("", scs[:3])
+
+	var moved int
+	for i := 0; i < 1000; i++ {
+		ctx := WithHashKey(context.Background(), fmt.Sprintf("user-%d", i))
+		b, a := pick(t, before, ctx), pick(t, after, ctx)
+		if b == scs[3].name {
+			moved++
+			continue
+		}
+		if b != a {
+			t.Fatalf("user-%d: moved from %s to %s", i, b, a)
+		}
+	}
+	// About a quarter of the keys were on the removed SubConn
+	if moved < 150 || moved > 350 {
+		t.Fatalf("want about 250 keys moved, have %d", moved)
+	}
+}
+
+func TestPickWithWeights(t *testing.T) {
+	scs := []*testSubConn{{name: "10.0.0.1:9000"}, {name: "10.0.0.2:9000"}}
+	p := buildPicker("", scs, 3, 1)
+
+	picks := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		picks[pick(t, p, WithHashKey(context.Background(), fmt.Sprintf("user-%d", i)))]++
+	}
+	if have := picks[scs[0].name]; have < 650 || have > 850 {
+		t.Fatalf("picks of %s: want about 750, have %d", scs[0].name, have)
+	}
+}
+
+func TestPickWithLargeWeights(t *testing.T) {
+	// Weights of DNS SRV records go up to 65535
+	var scs []*testSubConn
+	var weights []uint32
+	for i := 0; i < 10; i++ {
+		scs = append(scs, &testSubConn{name: fmt.Sprintf("10.0.0.%d:9000", i+1)})
+		weights = append(weights, 65535)
+	}
+	scs = append(scs, &testSubConn{name: "10.0.0.100:9000"})
+	weights = append(weights, 1)
+	p := buildPicker("", scs, weights...)
+
+	ring := p.(*picker).ring
+	if have := len(ring); have > maxRingSize {
+		t.Fatalf("want at most %d entries, have %d", maxRingSize, have)
+	}
+	entries := make(map[string]int)
+	for _, e := range ring {
+		entries[e.sc.(*testSubConn).name]++
+	}
+	for _, sc := range scs[:10] {
+		if have := entries[sc.name]; have < maxRingSize/11 {
+			t.Errorf("%s: want about %d entries, have %d", sc.name, maxRingSize/10, have)
+		}
+	}
+	// Addresses with a tiny weight still get an entry
+	if want, have := 1, entries[scs[10].name]; want != have {
+		t.Errorf("%s: want %d entries, have %d", scs[10].name, want, have)
+	}
+}
+
+func TestPickerWithoutSubConns(t *testing.T) {
+	p := (&pickerBuilder{}).Build(base.PickerBuildInfo{})
+	if _, err := p.Pick(balancer.PickInfo{}); err != balancer.ErrNoSubConnAvailable {
+		t.Fatalf("Pick: want %v, have %v", balancer.ErrNoSubConnAvailable, err)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		JSON     string
+		Header   string
+		Replicas int
+		Err      bool
+	}{
+		{`{}`, "", 0, false},
+		{`{"header":"x-user-id"}`, "x-user-id", 0, false},
+		{`{"header":"x-user-id","replicas":64}`, "x-user-id", 64, false},
+		{`{"replicas":-1}`, "", 0, true},
+		{`{"replicas":"many"}`, "", 0, true},
+	}
+	for i, tt := range tests {
+		cfg, err := (&builder{}).ParseConfig([]byte(tt.JSON))
+		if tt.Err {
+			if err == nil {
+				t.Errorf("#%d: want error, have nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if want, have := tt.Header, cfg.(*config).Header; want != have {
+			t.Errorf("#%d: Header: want %q, have %q", i, want, have)
+		}
+		if want, have := tt.Replicas, cfg.(*config).Replicas; want != have {
+			t.Errorf("#%d: Replicas: want %d, have %d", i, want, have)
+		}
+	}
+}
+
+func TestBalancerIsRegistered(t *testing.T) {
+	if balancer.Get(Name) == nil {
+		t.Fatalf("want balancer %q to be registered", Name)
+	}
+}
+
+func TestBalancerWithServiceConfig(t *testing.T) {
+	// Start servers that report their address in a header
+	var addrs []resolver.Address
+	for i := 0; i < 3; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := lis.Addr().String()
+		srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			grpc.SetHeader(ctx, metadata.Pairs("server", addr))
+			return handler(ctx, req)
+		}))
+		healthpb.RegisterHealthServer(srv, health.NewServer())
+		go srv.Serve(lis)
+		defer srv.Stop()
+		addrs = append(addrs, resolver.Address{Addr: addr})
+	}
+
+	r := manual.NewBuilderWithScheme("ringhash")
+	r.InitialState(resolver.State{Addresses: addrs})
+	conn, err := grpc.NewClient(r.Scheme()+":///test",
+		grpc.WithResolvers(r),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"ring_hash":{"header":"x-user-id"}}]}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	check := func(key string) string {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-user-id", key)
+		var header metadata.MD
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true), grpc.Header(&header))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return header.Get("server")[0]
+	}
+
+	// Wait until RPCs reach all servers, i.e. all of them are ready
+	seen := make(map[string]bool)
+	for i := 0; len(seen) < len(addrs); i++ {
+		if i == 1000 {
+			t.Fatalf("want RPCs on %d servers, have %d", len(addrs), len(seen))
+		}
+		seen[check(fmt.Sprintf("user-%d", i))] = true
+	}
+
+	// The same key always goes to the same server
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		server := check(key)
+		for j := 0; j < 3; j++ {
+			if want, have := server, check(key); want != have {
+				t.Fatalf("%s: want %s, have %s", key, want, have)
+			}
+		}
+	}
+}
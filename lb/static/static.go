@@ -5,41 +5,152 @@
 package static
 
 import (
-	"google.golang.org/grpc/naming"
+	"errors"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/resolver"
 )
 
-// Resolver implements a gRPC resolver/watcher that simply returns
-// a list of addresses, then blocks.
-type Resolver struct {
-	addr []*naming.Update
+// Scheme is the scheme the Builder is registered with in gRPC.
+// Use e.g. "static:///127.0.0.1:10000,127.0.0.1:10001" as a target
+// to resolve to the given list of addresses.
+const Scheme = "static"
+
+var (
+	// ErrClosed is returned when updating the addresses of a closed Resolver.
+	ErrClosed = errors.New("resolver is closed")
+)
+
+func init() {
+	resolver.Register(NewBuilder())
 }
 
-// NewResolver initializes and returns a new Resolver.
-func NewResolver(addr ...string) *Resolver {
-	r := &Resolver{}
-	for _, a := range addr {
-		r.addr = append(r.addr, &naming.Update{Op: naming.Add, Addr: a})
+// Builder implements the gRPC resolver.Builder interface. It creates
+// a Resolver for targets of the form static:///host1:port1,host2:port2.
+//
+// If the target has no addresses, the Resolver uses the addresses passed
+// to NewBuilder. Use NewBuilder together with grpc.WithResolvers to pass
+// a Builder whose addresses you want to change at runtime.
+type Builder struct {
+	mu        sync.Mutex // held while pushing addrs, before Resolver.mu
+	addrs     []resolver.Address
+	resolvers map[*Resolver]struct{} // resolvers using addrs
+}
+
+// NewBuilder initializes and returns a new Builder.
+func NewBuilder(addr ...string) *Builder {
+	return &Builder{
+		addrs:     makeAddresses(addr),
+		resolvers: make(map[*Resolver]struct{}),
 	}
-	return r
 }
 
-// Resolve creates a watcher for target. The watcher interface is implemented
-// by Resolver as well, see Next and Close.
-func (r *Resolver) Resolve(target string) (naming.Watcher, error) {
+// Scheme returns the scheme supported by the Builder.
+func (b *Builder) Scheme() string {
+	return Scheme
+}
+
+// Build creates a new Resolver for the given target.
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	addrs := makeAddresses(parseTarget(target))
+
+	r := &Resolver{b: b, cc: cc}
+	if len(addrs) > 0 {
+		if err := r.SetAddresses(addrs...); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	// Push the addresses of the Builder while holding its lock, so that
+	// a concurrent SetAddresses can't push newer addresses first
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := r.SetAddresses(b.addrs...); err != nil {
+		return nil, err
+	}
+	b.resolvers[r] = struct{}{}
 	return r, nil
 }
 
-// Next returns the list of addresses once, then blocks on consecutive calls.
-func (r *Resolver) Next() ([]*naming.Update, error) {
-	if r.addr != nil {
-		updates := r.addr
-		r.addr = nil
-		return updates, nil
+// UpdateAddresses replaces the list of addresses of the Builder and
+// of all Resolvers using them, i.e. Resolvers for targets without
+// addresses. Resolvers for targets with addresses are left alone.
+func (b *Builder) UpdateAddresses(addr ...string) {
+	b.SetAddresses(makeAddresses(addr)...)
+}
+
+// SetAddresses is like UpdateAddresses but allows to pass addresses
+// with attributes, e.g. weights via weighted.SetWeight.
+func (b *Builder) SetAddresses(addrs ...resolver.Address) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.addrs = addrs
+	for r := range b.resolvers {
+		r.SetAddresses(addrs...)
 	}
-	infinite := make(chan struct{})
-	<-infinite
-	return nil, nil
 }
 
-// Close is a no-op for a Resolver.
-func (r *Resolver) Close() {}
+// makeAddresses converts a list of host:port strings to addresses.
+func makeAddresses(addr []string) []resolver.Address {
+	addrs := make([]resolver.Address, len(addr))
+	for i, a := range addr {
+		addrs[i] = resolver.Address{Addr: a}
+	}
+	return addrs
+}
+
+// parseTarget returns the list of addresses specified in target.
+func parseTarget(target resolver.Target) []string {
+	var addr []string
+	for _, a := range strings.Split(target.Endpoint(), ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addr = append(addr, a)
+		}
+	}
+	return addr
+}
+
+// Resolver implements a gRPC resolver that simply returns a list of
+// addresses. The list can be replaced at runtime with UpdateAddresses.
+type Resolver struct {
+	b  *Builder
+	cc resolver.ClientConn
+
+	mu     sync.Mutex // serializes calls to UpdateState
+	closed bool
+}
+
+// UpdateAddresses replaces the list of addresses and pushes it to
+// the gRPC ClientConn. It returns ErrClosed if the Resolver is closed.
+func (r *Resolver) UpdateAddresses(addr ...string) error {
+	return r.SetAddresses(makeAddresses(addr)...)
+}
+
+// SetAddresses is like UpdateAddresses but allows to pass addresses
+// with attributes, e.g. weights via weighted.SetWeight.
+func (r *Resolver) SetAddresses(addrs ...resolver.Address) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	return r.cc.UpdateState(resolver.State{Addresses: addrs})
+}
+
+// ResolveNow is a no-op for a Resolver.
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+// Close removes the Resolver from its Builder. It no longer receives
+// updates via Builder.UpdateAddresses, and the ClientConn receives no
+// more updates after Close returns.
+func (r *Resolver) Close() {
+	r.b.mu.Lock()
+	delete(r.b.resolvers, r)
+	r.b.mu.Unlock()
+
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+}
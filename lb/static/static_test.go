@@ -5,54 +5,207 @@
 package static
 
 import (
+	"errors"
+	"net/url"
+	"sync"
 	"testing"
-	"time"
 
-	"google.golang.org/grpc/naming"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/olivere/grpc/lb/weighted"
 )
 
+// testClientConn implements resolver.ClientConn and records the
+// states pushed by the Resolver.
+type testClientConn struct {
+	resolver.ClientConn // unimplemented methods panic
+
+	states []resolver.State
+	err    error // returned from UpdateState
+}
+
+func (cc *testClientConn) UpdateState(state resolver.State) error {
+	cc.states = append(cc.states, state)
+	return cc.err
+}
+
 func TestResolver(t *testing.T) {
 	addr := []string{"node1:1000", "node2:2000"}
-	r := NewResolver(addr...)
-	w, err := r.Resolve("")
+	b := NewBuilder(addr...)
+	cc := &testClientConn{}
+	r, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	w.Close() // doesn't do anything, and cause no harm
+	if want, have := 1, len(cc.states); want != have {
+		t.Fatalf("retrieve states via UpdateState: want %d, have %d", want, have)
+	}
+	state := cc.states[0]
+	if want, have := len(addr), len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+	if want, have := addr[0], state.Addresses[0].Addr; want != have {
+		t.Fatalf("1st Addr: want %q, have %q", want, have)
+	}
+	if want, have := addr[1], state.Addresses[1].Addr; want != have {
+		t.Fatalf("2nd Addr: want %q, have %q", want, have)
+	}
+
+	// Replace the addresses at runtime
+	b.UpdateAddresses("node3:3000")
+	if want, have := 2, len(cc.states); want != have {
+		t.Fatalf("retrieve states via UpdateState: want %d, have %d", want, have)
+	}
+	state = cc.states[1]
+	if want, have := 1, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+	if want, have := "node3:3000", state.Addresses[0].Addr; want != have {
+		t.Fatalf("1st Addr: want %q, have %q", want, have)
+	}
+
+	// A closed Resolver no longer receives updates
+	r.Close()
+	b.UpdateAddresses("node4:4000")
+	if want, have := 2, len(cc.states); want != have {
+		t.Fatalf("retrieve states via UpdateState: want %d, have %d", want, have)
+	}
+	if want, have := ErrClosed, r.(*Resolver).UpdateAddresses("node4:4000"); want != have {
+		t.Fatalf("UpdateAddresses after Close: want %v, have %v", want, have)
+	}
+}
 
-	updates, err := w.Next()
+func TestResolverWithTarget(t *testing.T) {
+	u, err := url.Parse("static:///node1:1000,node2:2000")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want, have := len(addr), len(updates); want != have {
-		t.Fatalf("retrieve updates via Next(): want %d, have %d", want, have)
+	cc := &testClientConn{}
+	r, err := NewBuilder("node3:3000").Build(resolver.Target{URL: *u}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if want, have := addr[0], updates[0].Addr; want != have {
-		t.Fatalf("1st update Addr: want %q, have %q", want, have)
+	defer r.Close()
+
+	if want, have := 1, len(cc.states); want != have {
+		t.Fatalf("retrieve states via UpdateState: want %d, have %d", want, have)
 	}
-	if want, have := naming.Add, updates[0].Op; want != have {
-		t.Fatalf("1st update Op: want %v, have %v", want, have)
+	state := cc.states[0]
+	if want, have := 2, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
 	}
-	if want, have := addr[1], updates[1].Addr; want != have {
-		t.Fatalf("2nd update Addr: want %q, have %q", want, have)
+	if want, have := "node1:1000", state.Addresses[0].Addr; want != have {
+		t.Fatalf("1st Addr: want %q, have %q", want, have)
 	}
-	if want, have := naming.Add, updates[1].Op; want != have {
-		t.Fatalf("2nd update Op: want %v, have %v", want, have)
+	if want, have := "node2:2000", state.Addresses[1].Addr; want != have {
+		t.Fatalf("2nd Addr: want %q, have %q", want, have)
 	}
+}
 
-	// Further calls to w.Next should block
-	res := make(chan struct{}, 1)
-	go func() {
-		_, err := w.Next()
+func TestBuilderUpdateAddressesWithTargets(t *testing.T) {
+	b := NewBuilder("node1:1000")
+	explicit := &testClientConn{}
+	u, err := url.Parse("static:///node2:2000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1, err := b.Build(resolver.Target{URL: *u}, explicit, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r1.Close()
+	fallback := &testClientConn{}
+	r2, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, fallback, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+
+	// Only the Resolver using the addresses of the Builder is updated
+	b.UpdateAddresses("node3:3000")
+	if want, have := 1, len(explicit.states); want != have {
+		t.Fatalf("explicit target: want %d states, have %d", want, have)
+	}
+	if want, have := "node2:2000", explicit.states[0].Addresses[0].Addr; want != have {
+		t.Fatalf("explicit target: want %q, have %q", want, have)
+	}
+	if want, have := 2, len(fallback.states); want != have {
+		t.Fatalf("target without addresses: want %d states, have %d", want, have)
+	}
+	if want, have := "node3:3000", fallback.states[1].Addresses[0].Addr; want != have {
+		t.Fatalf("target without addresses: want %q, have %q", want, have)
+	}
+}
+
+func TestBuilderUpdateAddressesWhileBuilding(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		b := NewBuilder("node1:1000")
+		cc := &testClientConn{}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.UpdateAddresses("node2:2000")
+		}()
+		r, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
 		if err != nil {
 			t.Fatal(err)
 		}
-		res <- struct{}{}
-	}()
-	select {
-	case <-res:
-		t.Fatal("further calls to Next() should block")
-	case <-time.After(250 * time.Millisecond):
+		wg.Wait()
+
+		// The Resolver must end up with the latest addresses
+		state := cc.states[len(cc.states)-1]
+		if want, have := "node2:2000", state.Addresses[0].Addr; want != have {
+			t.Fatalf("#%d: want %q, have %q", i, want, have)
+		}
+		r.Close()
+	}
+}
+
+func TestBuilderReturnsUpdateStateError(t *testing.T) {
+	b := NewBuilder("node1:1000")
+	cc := &testClientConn{err: errors.New("bad resolver state")}
+	if _, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{}); err != cc.err {
+		t.Fatalf("Build: want %v, have %v", cc.err, err)
+	}
+	if want, have := 0, len(b.resolvers); want != have {
+		t.Fatalf("want %d resolvers, have %d", want, have)
+	}
+
+	u, err := url.Parse("static:///node2:2000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Build(resolver.Target{URL: *u}, cc, resolver.BuildOptions{}); err != cc.err {
+		t.Fatalf("Build with target: want %v, have %v", cc.err, err)
+	}
+}
+
+func TestResolverSetAddresses(t *testing.T) {
+	b := NewBuilder()
+	cc := &testClientConn{}
+	r, err := b.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	b.SetAddresses(
+		weighted.SetWeight(resolver.Address{Addr: "node1:1000"}, 3),
+		resolver.Address{Addr: "node2:2000"},
+	)
+	if want, have := 2, len(cc.states); want != have {
+		t.Fatalf("retrieve states via UpdateState: want %d, have %d", want, have)
+	}
+	state := cc.states[1]
+	if want, have := 2, len(state.Addresses); want != have {
+		t.Fatalf("retrieve addresses via UpdateState: want %d, have %d", want, have)
+	}
+	if want, have := uint32(3), weighted.Weight(state.Addresses[0]); want != have {
+		t.Fatalf("1st Weight: want %d, have %d", want, have)
+	}
+	if want, have := uint32(1), weighted.Weight(state.Addresses[1]); want != have {
+		t.Fatalf("2nd Weight: want %d, have %d", want, have)
 	}
 }
@@ -0,0 +1,183 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+// Package weighted implements a weighted round-robin balancer for gRPC.
+//
+// The balancer distributes RPCs between the ready addresses in proportion
+// to their weights, using the smooth weighted round-robin algorithm of
+// nginx. Resolvers attach weights to addresses with SetWeight, e.g. the
+// Consul resolver uses the Passing and Warning weights of each instance.
+//
+// Select the balancer via the service config, e.g.:
+//
+//	grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"smooth_weighted_round_robin":{}}]}`)
+package weighted
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+// Name is the name the balancer is registered with in gRPC.
+const Name = "smooth_weighted_round_robin"
+
+func init() {
+	balancer.Register(NewBalancerBuilder(Name, NewPickerBuilder(), base.Config{}))
+}
+
+// NewPickerBuilder returns the picker builder of the balancer, e.g. to
+// wrap it with outlier detection (see package outlier).
+func NewPickerBuilder() base.PickerBuilder {
+	return &pickerBuilder{}
+}
+
+// NewBalancerBuilder is like base.NewBalancerBuilder, but pb always sees
+// the latest attributes of every address, e.g. its weight. The base
+// balancer keeps the address it created a SubConn with, so pb would never
+// see a change of the balancer attributes of an address that stays.
+func NewBalancerBuilder(name string, pb base.PickerBuilder, config base.Config) balancer.Builder {
+	return &builder{name: name, pb: pb, config: config}
+}
+
+// builder creates balancers that pass the latest addresses to pb.
+type builder struct {
+	name   string
+	pb     base.PickerBuilder
+	config base.Config
+}
+
+// Name returns the name of the balancer.
+func (b *builder) Name() string {
+	return b.name
+}
+
+// Build creates a new balancer for cc.
+func (b *builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &latestPickerBuilder{pb: b.pb, addrs: resolver.NewAddressMapV2[resolver.Address]()}
+	return &latestBalancer{
+		Balancer: base.NewBalancerBuilder(b.name, pb, b.config).Build(cc, opts),
+		pb:       pb,
+	}
+}
+
+// latestBalancer passes the addresses from the resolver to its
+// picker builder.
+type latestBalancer struct {
+	balancer.Balancer
+	pb *latestPickerBuilder
+}
+
+// UpdateClientConnState is called by gRPC when the state of the
+// ClientConn changes.
+func (b *latestBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	b.pb.update(s.ResolverState.Addresses)
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+// latestPickerBuilder replaces the address of every ready SubConn with
+// the latest address from the resolver before it passes them to pb.
+type latestPickerBuilder struct {
+	pb base.PickerBuilder
+
+	mu    sync.Mutex
+	addrs *resolver.AddressMapV2[resolver.Address]
+}
+
+// update records the latest addresses from the resolver.
+func (b *latestPickerBuilder) update(addrs []resolver.Address) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.addrs = resolver.NewAddressMapV2[resolver.Address]()
+	for _, addr := range addrs {
+		b.addrs.Set(addr, addr)
+	}
+}
+
+// Build creates a new picker.
+func (b *latestPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	b.mu.Lock()
+	latest := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo, len(info.ReadySCs))}
+	for sc, sci := range info.ReadySCs {
+		if addr, ok := b.addrs.Get(sci.Address); ok {
+			sci.Address = addr
+		}
+		latest.ReadySCs[sc] = sci
+	}
+	b.mu.Unlock()
+	return b.pb.Build(latest)
+}
+
+// weightKey is the key for the weight in the balancer attributes
+// of a resolver.Address.
+type weightKey struct{}
+
+// SetWeight returns a copy of addr with the given weight attached.
+func SetWeight(addr resolver.Address, weight uint32) resolver.Address {
+	addr.BalancerAttributes = addr.BalancerAttributes.WithValue(weightKey{}, weight)
+	return addr
+}
+
+// Weight returns the weight attached to addr. If addr has no weight
+// or a weight of 0, it returns 1.
+func Weight(addr resolver.Address) uint32 {
+	w, _ := addr.BalancerAttributes.Value(weightKey{}).(uint32)
+	if w == 0 {
+		return 1
+	}
+	return w
+}
+
+// pickerBuilder creates a picker from the ready SubConns.
+type pickerBuilder struct{}
+
+// Build creates a new picker.
+func (*pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	p := &picker{}
+	for sc, sci := range info.ReadySCs {
+		p.items = append(p.items, &item{
+			sc:     sc,
+			weight: int64(Weight(sci.Address)),
+		})
+	}
+	return p
+}
+
+// item is a SubConn with its weight and current weight, as required
+// by the smooth weighted round-robin algorithm.
+type item struct {
+	sc      balancer.SubConn
+	weight  int64
+	current int64
+}
+
+// picker picks SubConns with smooth weighted round-robin.
+type picker struct {
+	mu    sync.Mutex
+	items []*item
+}
+
+// Pick returns the SubConn to use for the next RPC.
+func (p *picker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *item
+	var total int64
+	for _, it := range p.items {
+		it.current += it.weight
+		total += it.weight
+		if best == nil || it.current > best.current {
+			best = it
+		}
+	}
+	best.current -= total
+
+	return balancer.PickResult{SubConn: best.sc}, nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package weighted
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+// testSubConn implements balancer.SubConn for testing.
+type testSubConn struct {
+	balancer.SubConn // unimplemented methods panic
+
+	name string
+}
+
+func TestWeight(t *testing.T) {
+	if want, have := uint32(1), Weight(resolver.Address{Addr: "127.0.0.1:1000"}); want != have {
+		t.Errorf("Weight without weight: want %d, have %d", want, have)
+	}
+	if want, have := uint32(1), Weight(SetWeight(resolver.Address{Addr: "127.0.0.1:1000"}, 0)); want != have {
+		t.Errorf("Weight with weight 0: want %d, have %d", want, have)
+	}
+	if want, have := uint32(5), Weight(SetWeight(resolver.Address{Addr: "127.0.0.1:1000"}, 5)); want != have {
+		t.Errorf("Weight: want %d, have %d", want, have)
+	}
+}
+
+func TestPicker(t *testing.T) {
+	sc1 := &testSubConn{name: "sc1"}
+	sc2 := &testSubConn{name: "sc2"}
+	sc3 := &testSubConn{name: "sc3"}
+	p := (&pickerBuilder{}).Build(base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			sc1: {Address: SetWeight(resolver.Address{Addr: "127.0.0.1:1000"}, 5)},
+			sc2: {Address: SetWeight(resolver.Address{Addr: "127.0.0.1:1001"}, 1)},
+			sc3: {Address: resolver.Address{Addr: "127.0.0.1:1002"}},
+		},
+	})
+
+	picks := make(map[string]int)
+	for i := 0; i < 700; i++ {
+		res, err := p.Pick(balancer.PickInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[res.SubConn.(*testSubConn).name]++
+	}
+	if want, have := 500, picks["sc1"]; want != have {
+		t.Errorf("picks of sc1: want %d, have %d", want, have)
+	}
+	if want, have := 100, picks["sc2"]; want != have {
+		t.Errorf("picks of sc2: want %d, have %d", want, have)
+	}
+	if want, have := 100, picks["sc3"]; want != have {
+		t.Errorf("picks of sc3: want %d, have %d", want, have)
+	}
+}
+
+func TestPickerWithoutSubConns(t *testing.T) {
+	p := (&pickerBuilder{}).Build(base.PickerBuildInfo{})
+	if _, err := p.Pick(balancer.PickInfo{}); err != balancer.ErrNoSubConnAvailable {
+		t.Fatalf("Pick: want %v, have %v", balancer.ErrNoSubConnAvailable, err)
+	}
+}
+
+func TestLatestPickerBuilder(t *testing.T) {
+	sc1 := &testSubConn{name: "sc1"}
+	sc2 := &testSubConn{name: "sc2"}
+	pb := &latestPickerBuilder{pb: &pickerBuilder{}, addrs: resolver.NewAddressMapV2[resolver.Address]()}
+
+	// The base balancer passes the address it created the SubConn with
+	info := base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			sc1: {Address: SetWeight(resolver.Address{Addr: "127.0.0.1:1000"}, 1)},
+			sc2: {Address: SetWeight(resolver.Address{Addr: "127.0.0.1:1001"}, 1)},
+		},
+	}
+	pb.update([]resolver.Address{
+		SetWeight(resolver.Address{Addr: "127.0.0.1:1000"}, 3),
+		SetWeight(resolver.Address{Addr: "127.0.0.1:1001"}, 1),
+	})
+	p := pb.Build(info)
+
+	picks := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		res, err := p.Pick(balancer.PickInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[res.SubConn.(*testSubConn).name]++
+	}
+	if want, have := 300, picks["sc1"]; want != have {
+		t.Errorf("picks of sc1: want %d, have %d", want, have)
+	}
+	if want, have := 100, picks["sc2"]; want != have {
+		t.Errorf("picks of sc2: want %d, have %d", want, have)
+	}
+}
+
+func TestBalancerPicksUpWeightChanges(t *testing.T) {
+	// Start servers that report their address in a header
+	var addrs []resolver.Address
+	for i := 0; i < 2; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := lis.Addr().String()
+		srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			grpc.SetHeader(ctx, metadata.Pairs("server", addr))
+			return handler(ctx, req)
+		}))
+		healthpb.RegisterHealthServer(srv, health.NewServer())
+		go srv.Serve(lis)
+		defer srv.Stop()
+		addrs = append(addrs, resolver.Address{Addr: addr})
+	}
+
+	r := manual.NewBuilderWithScheme("weighted")
+	r.InitialState(resolver.State{Addresses: []resolver.Address{
+		SetWeight(addrs[0], 1),
+		SetWeight(addrs[1], 1),
+	}})
+	conn, err := grpc.NewClient(r.Scheme()+":///test",
+		grpc.WithResolvers(r),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"smooth_weighted_round_robin":{}}]}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	// share returns the number of RPCs out of 100 that reach addrs[0]
+	share := func() int {
+		var n int
+		for i := 0; i < 100; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			var header metadata.MD
+			_, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true), grpc.Header(&header))
+			cancel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Get("server")[0] == addrs[0].Addr {
+				n++
+			}
+		}
+		return n
+	}
+	// waitForShare waits until the share of addrs[0] is want
+	waitForShare := func(want int) {
+		t.Helper()
+		var have int
+		for i := 0; i < 50; i++ {
+			if have = share(); have == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("share of %s: want %d, have %d", addrs[0].Addr, want, have)
+	}
+
+	waitForShare(50)
+
+	// Change the weights of the same addresses
+	r.UpdateState(resolver.State{Addresses: []resolver.Address{
+		SetWeight(addrs[0], 9),
+		SetWeight(addrs[1], 1),
+	}})
+	waitForShare(90)
+}